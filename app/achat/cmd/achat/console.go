@@ -61,6 +61,11 @@ opensession jid 打开一个会话，聊天
 myid 获取当前节点信息
 conns 获取当前网络连接信息
 group_create 创建群
+group_get gid 获取群信息
+group_members gid 获取群成员
+group_addmember gid jid ... 添加群成员
+group_delmember gid jid ... 删除群成员
+group_drop gid 解散群
 exit 退出 shell
 
 `
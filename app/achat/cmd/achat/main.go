@@ -74,7 +74,10 @@ var (
 	tpscounter                                      = new(sync.Map)
 	homedir, bootnodes, capwd, leader, pwd, mailbox string
 	port, networkid, rpcport, muxport               int
-	nodiscover                                      bool
+	nodiscover, e2e, notifyExpired, mailboxOpen     bool
+	mailboxTTL                                      time.Duration
+	mailboxMaxMsgs, mailboxMaxBytes                 int64
+	mailboxRate                                     float64
 	p2pservice                                      alibp2p.Libp2pService
 	app                                             = cli.NewApp()
 	chatservice                                     *chat.ChatService
@@ -118,9 +121,48 @@ func init() {
 		},
 		cli.StringFlag{
 			Name:        "mailbox",
-			Usage:       "recv offline message",
+			Usage:       "recv offline message, split by ',' to replicate on several mailboxes",
 			Destination: &mailbox,
 		},
+		cli.BoolFlag{
+			Name:        "e2e",
+			Usage:       "encrypt normal message content end-to-end",
+			Destination: &e2e,
+		},
+		cli.DurationFlag{
+			Name:        "mailbox-ttl",
+			Usage:       "how long offline messages are kept when serving as mailbox",
+			Value:       7 * 24 * time.Hour,
+			Destination: &mailboxTTL,
+		},
+		cli.BoolFlag{
+			Name:        "mailbox-notify",
+			Usage:       "notify sender when an offline message expires undelivered",
+			Destination: &notifyExpired,
+		},
+		cli.BoolFlag{
+			Name:        "mailbox-open",
+			Usage:       "keep offline messages for jids that never bound to this mailbox (legacy clients)",
+			Destination: &mailboxOpen,
+		},
+		cli.Int64Flag{
+			Name:        "mailbox-max-msgs",
+			Usage:       "max offline messages kept for each recipient, 0 means no limit",
+			Value:       10000,
+			Destination: &mailboxMaxMsgs,
+		},
+		cli.Int64Flag{
+			Name:        "mailbox-max-bytes",
+			Usage:       "max offline message bytes kept for each recipient, 0 means no limit",
+			Value:       64 * 1024 * 1024,
+			Destination: &mailboxMaxBytes,
+		},
+		cli.Float64Flag{
+			Name:        "mailbox-rate",
+			Usage:       "max offline messages per second accepted from each sender, 0 means no limit",
+			Value:       10,
+			Destination: &mailboxRate,
+		},
 		cli.StringFlag{
 			Name:        "bootnodes",
 			Usage:       "bootnode list split by ','",
@@ -212,7 +254,11 @@ func achat(_ *cli.Context) error {
 	logMultiaddrs("host.listen_addrs", b.Host().Network().ListenAddresses())
 	logMultiaddrs("host.addrs", b.Host().Addrs())
 	myid, _ := p2pservice.Myid()
-	chatservice = chat.NewChatService(_ctx, chat.NewJID(myid, mailbox), homedir, p2pservice)
+	chatservice = chat.NewChatService(_ctx, chat.NewJID(myid, strings.Split(mailbox, ",")...), homedir, p2pservice)
+	chatservice.EnableE2E(e2e)
+	chatservice.SetMailboxTTL(mailboxTTL, notifyExpired)
+	chatservice.SetMailboxQuota(mailboxMaxMsgs, mailboxMaxBytes, mailboxRate, 100)
+	chatservice.SetMailboxOpen(mailboxOpen)
 	chatservice.AppendHandleMsg(func(service *chat.ChatService, msg *chat.Message) {
 		// log handler
 		log.Println("-->", msg)
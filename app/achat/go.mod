@@ -5,6 +5,7 @@ go 1.22
 require (
 	github.com/cc14514/go-achat-node v0.0.0-20200321034458-351a53523aa8
 	github.com/cc14514/go-alibp2p v0.0.3-rc5
+	github.com/multiformats/go-multiaddr v0.2.1
 	github.com/peterh/liner v1.1.0
 	github.com/urfave/cli v1.22.2
 	golang.org/x/net v0.15.0
@@ -80,7 +81,6 @@ require (
 	github.com/minio/sha256-simd v0.1.1 // indirect
 	github.com/mr-tron/base58 v1.1.3 // indirect
 	github.com/multiformats/go-base32 v0.0.3 // indirect
-	github.com/multiformats/go-multiaddr v0.2.1 // indirect
 	github.com/multiformats/go-multiaddr-dns v0.2.0 // indirect
 	github.com/multiformats/go-multiaddr-fmt v0.1.0 // indirect
 	github.com/multiformats/go-multiaddr-net v0.1.4 // indirect
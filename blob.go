@@ -0,0 +1,441 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/cc14514/go-alibp2p"
+	"github.com/tendermint/go-amino"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+/*
+文件和图片按内容寻址，保存在 homedir/blob/<sha256> ，消息通过 Payload.Attrs 引用：
+blob = sha256 的 hex ，blob_size / blob_mime / blob_name 为大小、类型和文件名；
+接收方通过 PID_BLOB 按范围下载，先找发送人，再找自己的 mailbox ；
+接收人离线时，发送人会先通过 PID_MAILBOX_BLOB 把文件传到接收人的 mailbox 上（见 mailbox_blob.go）。
+下载的 blob 保存在 homedir/blob_recv ，不对外提供；
+blob 不做端到端加密，节点自己上传的 blob 知道 hash 的节点都可以下载，hash 相当于下载凭证；
+分段写入时每个来源使用自己的 <sha256>.<来源>.part ，同一个 hash 同时从多处写入互不影响
+*/
+
+const (
+	BLOB_ATTR      = "blob"
+	BLOB_SIZE_ATTR = "blob_size"
+	BLOB_MIME_ATTR = "blob_mime"
+	BLOB_NAME_ATTR = "blob_name"
+
+	blobRangeSize = 256 * 1024
+	maxBlobSize   = 64 * 1024 * 1024
+)
+
+var (
+	errBlobNotFound = errors.New("blob not found")
+	errBadBlobHash  = errors.New("bad blob hash")
+)
+
+type (
+	Blob struct {
+		Hash string `json:"hash"`
+		Size int64  `json:"size"`
+		Mime string `json:"mime,omitempty"`
+		Name string `json:"name,omitempty"`
+	}
+
+	// Length 为 0 时只返回 Size ，用来判断 blob 是否存在
+	BlobReq struct {
+		Hash   string
+		Offset int64
+		Length int64
+	}
+
+	BlobRsp struct {
+		Size int64
+		Data []byte
+		Err  string
+	}
+
+	// 把 blob 按顺序分段上传到 To 的 mailbox
+	BlobPut struct {
+		To     JID
+		Hash   string
+		Size   int64
+		Offset int64
+		Data   []byte
+	}
+
+	blobStore struct {
+		lock  sync.Mutex
+		dir   string
+		locks map[string]*hashLock
+	}
+
+	hashLock struct {
+		sync.Mutex
+		n int // 等待和持有的个数，为 0 时删除
+	}
+)
+
+func (b *Blob) Attrs() []Attr {
+	attrs := []Attr{{Key: BLOB_ATTR, Val: b.Hash}, {Key: BLOB_SIZE_ATTR, Val: strconv.FormatInt(b.Size, 10)}}
+	if b.Mime != "" {
+		attrs = append(attrs, Attr{Key: BLOB_MIME_ATTR, Val: b.Mime})
+	}
+	if b.Name != "" {
+		attrs = append(attrs, Attr{Key: BLOB_NAME_ATTR, Val: b.Name})
+	}
+	return attrs
+}
+
+// 从消息中取出引用的 blob ，没有时返回 nil
+func BlobOf(msg *Message) *Blob {
+	h, ok := msg.Payload.GetAttr(BLOB_ATTR)
+	if !ok {
+		return nil
+	}
+	b := &Blob{Hash: h}
+	if s, ok := msg.Payload.GetAttr(BLOB_SIZE_ATTR); ok {
+		b.Size, _ = strconv.ParseInt(s, 10, 64)
+	}
+	b.Mime, _ = msg.Payload.GetAttr(BLOB_MIME_ATTR)
+	b.Name, _ = msg.Payload.GetAttr(BLOB_NAME_ATTR)
+	return b
+}
+
+func validBlobHash(hash string) bool {
+	buf, err := hex.DecodeString(hash)
+	return err == nil && len(buf) == sha256.Size
+}
+
+func newBlobStore(dir string) *blobStore {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		panic(err)
+	}
+	return &blobStore{dir: dir, locks: make(map[string]*hashLock)}
+}
+
+func (s *blobStore) path(hash string) string {
+	return path.Join(s.dir, hash)
+}
+
+// owner 为写入的来源，只能是 peerid 之类的文件名安全的字符串
+func (s *blobStore) partPath(owner, hash string) string {
+	return s.path(hash) + "." + owner + ".part"
+}
+
+// 锁住 hash ，返回的函数用来解锁
+func (s *blobStore) lockHash(hash string) func() {
+	s.lock.Lock()
+	l, ok := s.locks[hash]
+	if !ok {
+		l = new(hashLock)
+		s.locks[hash] = l
+	}
+	l.n++
+	s.lock.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if l.n--; l.n == 0 {
+			delete(s.locks, hash)
+		}
+	}
+}
+
+func (s *blobStore) size(hash string) (int64, bool) {
+	if !validBlobHash(hash) {
+		return 0, false
+	}
+	fi, err := os.Stat(s.path(hash))
+	if err != nil {
+		return 0, false
+	}
+	return fi.Size(), true
+}
+
+// 保存本地文件，返回 blob
+func (s *blobStore) putFile(fn, mimeType string) (*Blob, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tmp, err := os.CreateTemp(s.dir, "upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(f, maxBlobSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if size > maxBlobSize {
+		return nil, errors.New("blob too large")
+	}
+	if err = tmp.Close(); err != nil {
+		return nil, err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+	if err = os.Rename(tmp.Name(), s.path(hash)); err != nil {
+		return nil, err
+	}
+	if mimeType == "" {
+		mimeType = mime.TypeByExtension(filepath.Ext(fn))
+	}
+	return &Blob{Hash: hash, Size: size, Mime: mimeType, Name: filepath.Base(fn)}, nil
+}
+
+func (s *blobStore) read(hash string, offset, length int64) (*BlobRsp, error) {
+	size, ok := s.size(hash)
+	if !ok {
+		return nil, errBlobNotFound
+	}
+	if offset < 0 || offset > size {
+		return nil, errors.New("bad offset")
+	}
+	if length > blobRangeSize {
+		length = blobRangeSize
+	}
+	if length > size-offset {
+		length = size - offset
+	}
+	rsp := &BlobRsp{Size: size}
+	if length <= 0 {
+		return rsp, nil
+	}
+	f, err := os.Open(s.path(hash))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rsp.Data = make([]byte, length)
+	if _, err = f.ReadAt(rsp.Data, offset); err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
+// 把来自 owner 的一段顺序写入 owner 自己的 part 文件，写满 size 以后校验 hash ，返回是否完成
+func (s *blobStore) write(owner, hash string, size, offset int64, data []byte) (bool, error) {
+	if !validBlobHash(hash) {
+		return false, errBadBlobHash
+	}
+	if size <= 0 || size > maxBlobSize || offset+int64(len(data)) > size {
+		return false, errors.New("bad blob size")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	part := s.partPath(owner, hash)
+	if _, ok := s.size(hash); ok {
+		os.Remove(part)
+		return true, nil
+	}
+	if offset == 0 {
+		os.Remove(part)
+	}
+	f, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if fi.Size() != offset {
+		return false, errors.New("bad offset")
+	}
+	if _, err = f.Write(data); err != nil {
+		return false, err
+	}
+	if offset+int64(len(data)) < size {
+		return false, nil
+	}
+	if err = f.Close(); err != nil {
+		return false, err
+	}
+	if err = checkBlob(part, hash); err != nil {
+		os.Remove(part)
+		return false, err
+	}
+	return true, os.Rename(part, s.path(hash))
+}
+
+func (s *blobStore) remove(hash string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	os.Remove(s.path(hash))
+	if parts, err := filepath.Glob(s.path(hash) + ".*.part"); err == nil {
+		for _, part := range parts {
+			os.Remove(part)
+		}
+	}
+}
+
+// 已经从 owner 下载的部分，用于断点续传
+func (s *blobStore) partSize(owner, hash string) int64 {
+	fi, err := os.Stat(s.partPath(owner, hash))
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+func checkBlob(fn, hash string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != hash {
+		return errBadBlobHash
+	}
+	return nil
+}
+
+func (c *ChatService) blobService() {
+	c.p2pservice.SetHandler(PID_BLOB, func(sessionId string, pubkey *ecdsa.PublicKey, rw io.ReadWriter) error {
+		req := new(BlobReq)
+		_, err := amino.UnmarshalBinaryLengthPrefixedReader(rw, req, 256)
+		if err == nil {
+			var rsp *BlobRsp
+			// 只提供自己上传的，没有时找 mailbox 替请求人代存的
+			if rsp, err = c.blobs.read(req.Hash, req.Offset, req.Length); err == errBlobNotFound {
+				var from string
+				if from, err = alibp2p.ECDSAPubEncode(pubkey); err == nil {
+					rsp, err = c.mbox.readBlob(from, req)
+				}
+			}
+			if err == nil {
+				_, err = rw.Write(mustToByte(rsp))
+				return err
+			}
+		}
+		log.Println("PID_BLOB error", "session", sessionId, "hash", req.Hash, "err", err)
+		rw.Write(mustToByte(&BlobRsp{Err: err.Error()}))
+		return err
+	})
+}
+
+func (c *ChatService) requestBlob(to string, req *BlobReq) (*BlobRsp, error) {
+	rtn, err := c.p2pservice.RequestWithTimeout(to, PID_BLOB, mustToByte(req), timeout)
+	if err != nil {
+		return nil, err
+	}
+	rsp := new(BlobRsp)
+	if err = amino.UnmarshalBinaryLengthPrefixed(rtn, rsp); err != nil {
+		return nil, err
+	}
+	if rsp.Err != "" {
+		return nil, errors.New(rsp.Err)
+	}
+	return rsp, nil
+}
+
+// 按范围从 to 下载到 blob_recv ，支持断点续传
+func (c *ChatService) fetchBlob(to, hash string) error {
+	for offset := c.recvBlobs.partSize(to, hash); ; {
+		rsp, err := c.requestBlob(to, &BlobReq{Hash: hash, Offset: offset, Length: blobRangeSize})
+		if err != nil {
+			return err
+		}
+		if len(rsp.Data) == 0 {
+			return errors.New("blob truncated")
+		}
+		done, err := c.recvBlobs.write(to, hash, rsp.Size, offset, rsp.Data)
+		if err != nil || done {
+			return err
+		}
+		offset += int64(len(rsp.Data))
+	}
+}
+
+// 把本地的 blob 传到 mailid ，mailbox 上已经有的不再上传
+func (c *ChatService) pushBlob(mailid string, to JID, hash string) error {
+	if rsp, err := c.requestBlob(mailid, &BlobReq{Hash: hash}); err == nil && rsp.Size > 0 {
+		return nil
+	}
+	size, ok := c.blobs.size(hash)
+	if !ok {
+		return errBlobNotFound
+	}
+	for offset := int64(0); offset < size; {
+		rsp, err := c.blobs.read(hash, offset, blobRangeSize)
+		if err != nil {
+			return err
+		}
+		put := &BlobPut{To: to, Hash: hash, Size: size, Offset: offset, Data: rsp.Data}
+		rtn, err := c.p2pservice.RequestWithTimeout(mailid, PID_MAILBOX_BLOB, mustToByte(put), timeout)
+		if err != nil {
+			return err
+		}
+		if err = readRsp(rtn); err != nil {
+			return err
+		}
+		offset += int64(len(rsp.Data))
+	}
+	return nil
+}
+
+// 保存本地文件，返回的 blob 可以用 Blob.Attrs 附加到消息上
+func (c *ChatService) PutBlob(fn, mimeType string) (*Blob, error) {
+	return c.blobs.putFile(fn, mimeType)
+}
+
+// 下载 from 发来的 blob ，先找 from ，再依次找自己的 mailbox ，返回本地文件路径
+func (c *ChatService) GetBlob(from JID, hash string) (string, error) {
+	if !validBlobHash(hash) {
+		return "", errBadBlobHash
+	}
+	if _, ok := c.blobs.size(hash); ok {
+		return c.blobs.path(hash), nil
+	}
+	// 同一个 hash 同时只下载一次
+	unlock := c.recvBlobs.lockHash(hash)
+	defer unlock()
+	if _, ok := c.recvBlobs.size(hash); ok {
+		return c.recvBlobs.path(hash), nil
+	}
+	err := errBlobNotFound
+	for _, to := range append([]string{from.Peerid()}, c.myid.Mailids()...) {
+		if to == "" {
+			continue
+		}
+		if err = c.fetchBlob(to, hash); err == nil {
+			return c.recvBlobs.path(hash), nil
+		}
+		log.Println("getBlob error", "hash", hash, "from", to, "err", err)
+	}
+	return "", err
+}
+
+// 发送引用 blob 的消息
+func (c *ChatService) SendBlob(to JID, b *Blob, content string) (*Message, error) {
+	size, ok := c.blobs.size(b.Hash)
+	if !ok {
+		return nil, errBlobNotFound
+	}
+	b.Size = size
+	msg := NewNormalMessage(c.myid, to, content, b.Attrs()...)
+	msg.Envelope.Ack = ACK
+	return msg, c.SendMsg(msg)
+}
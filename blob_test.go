@@ -0,0 +1,90 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlobStore(t *testing.T) {
+	var (
+		src  = newBlobStore(filepath.Join(t.TempDir(), "src"))
+		dst  = newBlobStore(filepath.Join(t.TempDir(), "dst"))
+		data = make([]byte, blobRangeSize*2+100)
+		fn   = filepath.Join(t.TempDir(), "a.png")
+	)
+	rand.Read(data)
+	if err := os.WriteFile(fn, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := src.putFile(fn, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Size != int64(len(data)) || b.Mime != "image/png" || b.Name != "a.png" {
+		t.Fatal("bad blob", b)
+	}
+	msg := NewNormalMessage(testOwner, testMember1, "", b.Attrs()...)
+	if got := BlobOf(msg); *got != *b {
+		t.Fatal("bad blob attrs", got)
+	}
+
+	// 按范围复制，中途断开以后从 partSize 继续
+	rsp, err := src.read(b.Hash, 0, blobRangeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done, err := dst.write("src", b.Hash, rsp.Size, 0, rsp.Data); err != nil || done {
+		t.Fatal("first range", done, err)
+	}
+	if _, err := dst.write("src", b.Hash, rsp.Size, 0+1, rsp.Data); err == nil {
+		t.Fatal("bad offset must fail")
+	}
+	// 另一个来源同时写同一个 hash 不影响
+	if done, err := dst.write("peer2", b.Hash, rsp.Size, 0, rsp.Data); err != nil || done {
+		t.Fatal("other owner", done, err)
+	}
+	for offset := dst.partSize("src", b.Hash); ; {
+		rsp, err := src.read(b.Hash, offset, blobRangeSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done, err := dst.write("src", b.Hash, rsp.Size, offset, rsp.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if done {
+			break
+		}
+		offset += int64(len(rsp.Data))
+	}
+	got, err := os.ReadFile(dst.path(b.Hash))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatal("bad copy", err)
+	}
+	if done, err := dst.write("peer2", b.Hash, rsp.Size, rsp.Size, nil); err != nil || !done || dst.partSize("peer2", b.Hash) != 0 {
+		t.Fatal("finished blob must drop other parts", done, err)
+	}
+	if rsp, err := dst.read(b.Hash, 0, 0); err != nil || rsp.Size != b.Size || len(rsp.Data) != 0 {
+		t.Fatal("stat must return size only", err)
+	}
+
+	// 内容和 hash 不符
+	other := newBlobStore(filepath.Join(t.TempDir(), "other"))
+	bad := append([]byte{}, data[:10]...)
+	bad[0] ^= 0xff
+	if _, err := other.write("src", b.Hash, 10, 0, bad); err != errBadBlobHash {
+		t.Fatal("want bad hash", err)
+	}
+	if _, ok := other.size(b.Hash); ok {
+		t.Fatal("bad blob must not be saved")
+	}
+	if _, err := other.read("../../etc/passwd", 0, 1); err != errBlobNotFound {
+		t.Fatal("invalid hash must not be read", err)
+	}
+}
@@ -0,0 +1,229 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"github.com/cc14514/go-alibp2p"
+	"github.com/tendermint/go-amino"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+能力协商：通过 PID_CAPS 交换双方的 Caps ，请求和响应都是自己的 Caps ，
+结果按 peerid 缓存 capsTTL ；对方不支持 PID_CAPS 时按旧版本处理（legacyCaps），
+发送时没有缓存的在后台查询，这次按默认行为处理，不等待结果；
+SendMsg 根据接收人和 mailbox 的 Caps 判断是否可以分块，开启 e2e 时对方不支持加密直接返回错误，对方不支持回执时不发回执；
+消息的编码只有一种，Caps.Vsn 只用来展示，不影响发出的消息；
+QueryMsg 在 mailbox 不支持 PID_MAILBOX_PAGE 时用 PID_MAILBOX_QUERY
+*/
+
+const (
+	PID_CAPS = "/chat/caps/0.0.1"
+	MSG_VSN  = "0.0.2" // Message.Vsn
+
+	FEATURE_E2E      = "e2e"      // 端到端加密
+	FEATURE_CHUNK    = "chunk"    // 超过 MAX_PKG 的消息分块传输
+	FEATURE_RECEIPT  = "receipt"  // 送达 / 已读回执
+	FEATURE_RESPONSE = "response" // 协议返回 Response
+	FEATURE_BLOB     = "blob"
+	FEATURE_PAGE     = "page" // mailbox 分页查询
+	FEATURE_RTP      = "rtp"
+)
+
+var (
+	capsTTL     = 10 * time.Minute
+	capsMissTTL = time.Minute // 问不到的 peer 在这段时间内不再问
+	capsTimeout = 3 * time.Second
+
+	errChunkNotSupport = errors.New("message too large for peer")
+	errNotSigned       = errors.New("message not signed")
+	errE2ENotSupport   = errors.New("peer does not support e2e")
+
+	localCaps = &Caps{
+		Vsn: MSG_VSN,
+		Protocols: []string{PID_NORMAL, PID_RTP, PID_CHUNK, PID_BLOB, PID_CAPS,
+			PID_MAILBOX, PID_MAILBOX_QUERY, PID_MAILBOX_PAGE, PID_MAILBOX_CLEAN, PID_MAILBOX_BIND, PID_MAILBOX_BLOB,
+			PID_MAILBOX_GROUP_UPDATE, PID_MAILBOX_GROUP_GET, PID_MAILBOX_GROUP_DROP, PID_MAILBOX_GROUP_MSG, PID_MAILBOX_GROUP_MEMBER, PID_MAILBOX_GROUP_HISTORY},
+		Features: []string{FEATURE_E2E, FEATURE_CHUNK, FEATURE_RECEIPT, FEATURE_RESPONSE, FEATURE_BLOB, FEATURE_PAGE, FEATURE_RTP},
+	}
+	// 没有 PID_CAPS 的节点，只列出旧版本注册了 handler 的协议
+	legacyCaps = &Caps{
+		Vsn: MSG_VSN,
+		Protocols: []string{PID_NORMAL, PID_MAILBOX, PID_MAILBOX_QUERY, PID_MAILBOX_CLEAN,
+			PID_MAILBOX_GROUP_UPDATE, PID_MAILBOX_GROUP_MEMBER},
+	}
+)
+
+type (
+	Caps struct {
+		Vsn       string   `json:"vsn"` // 支持的最高消息版本
+		Protocols []string `json:"protocols"`
+		Features  []string `json:"features"`
+	}
+
+	capsEntry struct {
+		caps *Caps // nil 表示没有问到
+		at   time.Time
+	}
+
+	capsCache struct {
+		lock     sync.Mutex
+		peers    map[string]*capsEntry
+		inflight map[string]struct{} // 正在后台查询的 peer
+	}
+)
+
+func (caps *Caps) Has(feature string) bool {
+	for _, f := range caps.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+func (caps *Caps) Supports(pid string) bool {
+	for _, p := range caps.Protocols {
+		if p == pid {
+			return true
+		}
+	}
+	return false
+}
+
+// 没有 PID_CAPS 的旧版本节点，不会给消息签名
+func (caps *Caps) legacy() bool {
+	return !caps.Supports(PID_CAPS)
+}
+
+func newCapsCache() *capsCache {
+	return &capsCache{peers: make(map[string]*capsEntry), inflight: make(map[string]struct{})}
+}
+
+// 同一个 peer 同时只查询一次，返回 false 表示已经在查询
+func (cc *capsCache) start(peerid string) bool {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	if _, ok := cc.inflight[peerid]; ok {
+		return false
+	}
+	cc.inflight[peerid] = struct{}{}
+	return true
+}
+
+func (cc *capsCache) finish(peerid string) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	delete(cc.inflight, peerid)
+}
+
+func (cc *capsCache) get(peerid string, now time.Time) (*Caps, bool) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	e, ok := cc.peers[peerid]
+	if !ok {
+		return nil, false
+	}
+	if (e.caps != nil && now.Sub(e.at) > capsTTL) || (e.caps == nil && now.Sub(e.at) > capsMissTTL) {
+		delete(cc.peers, peerid)
+		return nil, false
+	}
+	return e.caps, true
+}
+
+func (cc *capsCache) put(peerid string, caps *Caps, now time.Time) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	// 顺便清理过期的
+	for k, e := range cc.peers {
+		if now.Sub(e.at) > capsTTL {
+			delete(cc.peers, k)
+		}
+	}
+	cc.peers[peerid] = &capsEntry{caps: caps, at: now}
+}
+
+func (c *ChatService) capsService() {
+	c.p2pservice.SetHandler(PID_CAPS, func(sessionId string, pubkey *ecdsa.PublicKey, rw io.ReadWriter) error {
+		caps := new(Caps)
+		if _, err := amino.UnmarshalBinaryLengthPrefixedReader(rw, caps, MAX_PKG); err == nil {
+			if from, err := alibp2p.ECDSAPubEncode(pubkey); err == nil {
+				c.caps.put(from, caps, time.Now())
+			}
+		}
+		_, err := rw.Write(mustToByte(localCaps))
+		return err
+	})
+}
+
+// 查询 peer 支持的协议和功能，peerid 为空时返回自己的
+func (c *ChatService) Caps(peerid string) (*Caps, error) {
+	if peerid == "" || peerid == c.myid.Peerid() {
+		return localCaps, nil
+	}
+	rtn, err := c.p2pservice.RequestWithTimeout(peerid, PID_CAPS, mustToByte(localCaps), capsTimeout)
+	if err != nil {
+		if !strings.Contains(err.Error(), "protocol not supported") {
+			return nil, err
+		}
+		rtn, err = nil, nil
+	}
+	caps := legacyCaps
+	if rtn != nil {
+		caps = new(Caps)
+		if err = amino.UnmarshalBinaryLengthPrefixed(rtn, caps); err != nil {
+			return nil, err
+		}
+	}
+	c.caps.put(peerid, caps, time.Now())
+	return caps, nil
+}
+
+// 只用缓存，没有缓存时在后台查询并返回 nil ，调用方按自己的默认行为处理，不阻塞发送
+func (c *ChatService) capsOf(peerid string) *Caps {
+	if caps, ok := c.caps.get(peerid, time.Now()); ok {
+		return caps
+	}
+	if c.caps.start(peerid) {
+		go func() {
+			defer c.caps.finish(peerid)
+			c.loadCaps(peerid)
+		}()
+	}
+	return nil
+}
+
+// 没有缓存时同步查询，问不到时返回 nil ；只用于收到消息时判断对方是不是旧版本
+func (c *ChatService) capsWait(peerid string) *Caps {
+	if caps, ok := c.caps.get(peerid, time.Now()); ok {
+		return caps
+	}
+	return c.loadCaps(peerid)
+}
+
+func (c *ChatService) loadCaps(peerid string) *Caps {
+	caps, err := c.Caps(peerid)
+	if err != nil {
+		log.Println("caps error", "peer", peerid, "err", err)
+		c.caps.put(peerid, nil, time.Now())
+	}
+	return caps
+}
+
+// 超过 MAX_PKG 的数据只能发给支持分块的节点
+func (c *ChatService) checkSize(peerid string, data []byte) error {
+	if len(data) <= MAX_PKG {
+		return nil
+	}
+	if caps := c.capsOf(peerid); caps != nil && !caps.Has(FEATURE_CHUNK) {
+		return newResponse(RSP_NOT_SUPPORT, errChunkNotSupport).Err()
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCaps(t *testing.T) {
+	if !localCaps.Has(FEATURE_CHUNK) || !localCaps.Supports(PID_CAPS) {
+		t.Fatal("bad local caps")
+	}
+	if legacyCaps.Has(FEATURE_E2E) || legacyCaps.Supports(PID_CAPS) || !legacyCaps.Supports(PID_NORMAL) {
+		t.Fatal("bad legacy caps")
+	}
+	if legacyCaps.Supports(PID_MAILBOX_BIND) || !legacyCaps.Supports(PID_MAILBOX_GROUP_UPDATE) || !legacyCaps.Supports(PID_MAILBOX_GROUP_MEMBER) {
+		t.Fatal("legacy caps must match the legacy handlers")
+	}
+	var (
+		cc  = newCapsCache()
+		now = time.Now()
+	)
+	cc.put("a", localCaps, now)
+	cc.put("b", nil, now)
+	if caps, ok := cc.get("a", now.Add(capsMissTTL+time.Second)); !ok || caps != localCaps {
+		t.Fatal("caps must be cached", caps, ok)
+	}
+	if _, ok := cc.get("b", now.Add(capsMissTTL+time.Second)); ok {
+		t.Fatal("miss must expire")
+	}
+	if _, ok := cc.get("a", now.Add(capsTTL+time.Second)); ok {
+		t.Fatal("caps must expire")
+	}
+	if !cc.start("c") || cc.start("c") {
+		t.Fatal("only one lookup per peer")
+	}
+	cc.finish("c")
+	if !cc.start("c") {
+		t.Fatal("lookup must be allowed again")
+	}
+}
+
+func TestPrepareMsgE2ENotSupport(t *testing.T) {
+	var (
+		c   = &ChatService{caps: newCapsCache(), lock: new(sync.Mutex), e2e: true}
+		old = strings.Repeat("a", 53)
+	)
+	c.caps.put(old, legacyCaps, time.Now())
+	_, err := c.prepareMsg(NewNormalMessage("me", JID(old), "hello"))
+	if err == nil || IsRetryable(err) {
+		t.Fatal("must not send plaintext to a peer without e2e", err)
+	}
+}
+
+func TestVerifyNormal(t *testing.T) {
+	var (
+		c           = &ChatService{caps: newCapsCache()}
+		oldKey, old = newTestKey(t)
+		newKey, nw  = newTestKey(t)
+		now         = time.Now()
+	)
+	c.caps.put(old, legacyCaps, now)
+	c.caps.put(nw, localCaps, now)
+	// 旧版本节点没有签名的消息
+	msg := NewNormalMessage(JID(old), testOwner, "hello")
+	if err := c.verifyNormal(&oldKey.PublicKey, msg); err != nil {
+		t.Fatal("unsigned message from legacy peer must be accepted", err)
+	}
+	if err := c.verifyNormal(&newKey.PublicKey, msg); err == nil {
+		t.Fatal("from must match the connection")
+	}
+	if err := c.verifyNormal(&newKey.PublicKey, NewNormalMessage(JID(nw), testOwner, "hello")); err != errNotSigned {
+		t.Fatal("upgraded peer must sign", err)
+	}
+	// 有签名的必须验签通过
+	msg.Sig = []byte("bad")
+	if err := c.verifyNormal(&oldKey.PublicKey, msg); err == nil {
+		t.Fatal("bad signature must be rejected")
+	}
+}
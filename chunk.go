@@ -0,0 +1,207 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/cc14514/go-alibp2p"
+	"github.com/google/uuid"
+	"github.com/tendermint/go-amino"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+超过 MAX_PKG 的请求拆成多个 Chunk 通过 PID_CHUNK 发送：
+Chunk.Id 为传输 id ，Pid 为原来的协议，Hash 为完整数据的 sha256 ，
+接收方收齐以后校验 hash ，再交给 Pid 对应的 handler ，handler 的响应作为最后一个 Chunk 的响应返回，
+其余 Chunk 返回 SUCCESS
+*/
+
+const (
+	chunkSize      = MAX_PKG - 512 // 给 Chunk 的其他字段留出空间
+	maxChunkedSize = 1024 * 1024
+	maxTransfers   = 64
+)
+
+var chunkTimeout = 60 * time.Second
+
+type (
+	Chunk struct {
+		Id    string
+		Pid   string
+		Index int
+		Total int
+		Hash  []byte
+		Data  []byte
+	}
+
+	transfer struct {
+		pid    string
+		hash   []byte
+		chunks [][]byte
+		recv   int
+		ct     time.Time
+	}
+
+	// 收齐的数据交给 handler 时使用，Message.FromReader 会按 maxChunkedSize 限制读取
+	chunkRW struct {
+		*bytes.Reader
+		out bytes.Buffer
+	}
+
+	chunker struct {
+		lock       sync.Mutex
+		p2pservice alibp2p.Libp2pService
+		handlers   map[string]alibp2p.StreamHandler
+		transfers  map[string]*transfer
+	}
+)
+
+func (rw *chunkRW) Write(p []byte) (int, error) {
+	return rw.out.Write(p)
+}
+
+func readLimit(r io.Reader) int64 {
+	if _, ok := r.(*chunkRW); ok {
+		return maxChunkedSize
+	}
+	return MAX_PKG
+}
+
+func splitChunks(pid string, data []byte) []*Chunk {
+	var (
+		id     = uuid.New().String()
+		h      = sha256.Sum256(data)
+		total  = (len(data) + chunkSize - 1) / chunkSize
+		chunks = make([]*Chunk, 0, total)
+	)
+	for i := 0; i < total; i++ {
+		end := (i + 1) * chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunks = append(chunks, &Chunk{Id: id, Pid: pid, Index: i, Total: total, Hash: h[:], Data: data[i*chunkSize : end]})
+	}
+	return chunks
+}
+
+func newChunker(p2pservice alibp2p.Libp2pService) *chunker {
+	return &chunker{
+		p2pservice: p2pservice,
+		handlers:   make(map[string]alibp2p.StreamHandler),
+		transfers:  make(map[string]*transfer),
+	}
+}
+
+// 注册 handler ，同时允许通过 PID_CHUNK 接收超过 MAX_PKG 的请求
+func (c *chunker) SetHandler(pid string, handler alibp2p.StreamHandler) {
+	c.lock.Lock()
+	c.handlers[pid] = handler
+	c.lock.Unlock()
+	c.p2pservice.SetHandler(pid, handler)
+}
+
+// 数据不超过 MAX_PKG 时直接请求 pid ，否则分块发送
+func (c *chunker) request(to, pid string, data []byte) ([]byte, error) {
+	if len(data) <= MAX_PKG {
+		return c.p2pservice.RequestWithTimeout(to, pid, data, timeout)
+	}
+	if len(data) > maxChunkedSize {
+		return nil, errors.New("message too large")
+	}
+	var rtn []byte
+	for _, chunk := range splitChunks(pid, data) {
+		var err error
+		if rtn, err = c.p2pservice.RequestWithTimeout(to, PID_CHUNK, mustToByte(chunk), timeout); err != nil {
+			return nil, err
+		}
+		if chunk.Index < chunk.Total-1 && !bytes.Equal(rtn, SUCCESS) {
+			return nil, errors.New(string(rtn))
+		}
+	}
+	return rtn, nil
+}
+
+// 保存一个 Chunk ，收齐时返回完整的数据
+func (c *chunker) put(from string, chunk *Chunk) (string, []byte, error) {
+	if chunk.Total <= 0 || chunk.Total > maxChunkedSize/chunkSize+1 || chunk.Index < 0 || chunk.Index >= chunk.Total {
+		return "", nil, errors.New("bad chunk")
+	}
+	if len(chunk.Data) > chunkSize {
+		return "", nil, errors.New("chunk too large")
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.handlers[chunk.Pid]; !ok {
+		return "", nil, fmt.Errorf("protocol not support : %s", chunk.Pid)
+	}
+	now := time.Now()
+	for k, t := range c.transfers {
+		if now.Sub(t.ct) > chunkTimeout {
+			delete(c.transfers, k)
+		}
+	}
+	k := from + chunk.Id
+	t, ok := c.transfers[k]
+	if !ok {
+		if len(c.transfers) >= maxTransfers {
+			return "", nil, errors.New("too many transfers")
+		}
+		t = &transfer{pid: chunk.Pid, hash: chunk.Hash, chunks: make([][]byte, chunk.Total), ct: now}
+		c.transfers[k] = t
+	}
+	if t.pid != chunk.Pid || !bytes.Equal(t.hash, chunk.Hash) || len(t.chunks) != chunk.Total {
+		delete(c.transfers, k)
+		return "", nil, errors.New("chunk not match")
+	}
+	if t.chunks[chunk.Index] == nil {
+		t.chunks[chunk.Index] = chunk.Data
+		t.recv++
+	}
+	if t.recv < chunk.Total {
+		return "", nil, nil
+	}
+	delete(c.transfers, k)
+	data := bytes.Join(t.chunks, nil)
+	if h := sha256.Sum256(data); !bytes.Equal(h[:], t.hash) {
+		return "", nil, errors.New("bad chunk hash")
+	}
+	return t.pid, data, nil
+}
+
+func (c *chunker) start() {
+	c.p2pservice.SetHandler(PID_CHUNK, func(sessionId string, pubkey *ecdsa.PublicKey, rw io.ReadWriter) error {
+		chunk := new(Chunk)
+		_, err := amino.UnmarshalBinaryLengthPrefixedReader(rw, chunk, MAX_PKG)
+		if err != nil {
+			rw.Write([]byte(err.Error()))
+			return err
+		}
+		from, _ := alibp2p.ECDSAPubEncode(pubkey)
+		pid, data, err := c.put(from, chunk)
+		if err != nil {
+			log.Println("PID_CHUNK error", "session", sessionId, "from", from, "id", chunk.Id, "err", err)
+			rw.Write([]byte(err.Error()))
+			return err
+		}
+		if data == nil {
+			rw.Write(SUCCESS)
+			return nil
+		}
+		c.lock.Lock()
+		handler := c.handlers[pid]
+		c.lock.Unlock()
+		crw := &chunkRW{Reader: bytes.NewReader(data)}
+		err = handler(sessionId, pubkey, crw)
+		rw.Write(crw.out.Bytes())
+		return err
+	})
+}
@@ -0,0 +1,73 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestChunk(t *testing.T) {
+	c := newChunker(nil)
+	c.handlers[PID_NORMAL] = nil
+	msg := NewNormalMessage(testMember1, testOwner, strings.Repeat("log line\n", 1000))
+	data := msg.Bytes()
+	chunks := splitChunks(PID_NORMAL, data)
+	if len(chunks) < 2 {
+		t.Fatal("must be split", len(chunks))
+	}
+	for _, chunk := range chunks {
+		if len(mustToByte(chunk)) > MAX_PKG {
+			t.Fatal("chunk too large", len(mustToByte(chunk)))
+		}
+	}
+	// 乱序和重复都可以
+	n := len(chunks)
+	chunks = append([]*Chunk{chunks[n-1], chunks[0], chunks[0]}, chunks[1:n-1]...)
+	var (
+		pid  string
+		full []byte
+	)
+	for i, chunk := range chunks {
+		p, d, err := c.put(testMember1.Peerid(), chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d != nil {
+			if i != len(chunks)-1 {
+				t.Fatal("complete too early", i)
+			}
+			pid, full = p, d
+		}
+	}
+	if pid != PID_NORMAL || !bytes.Equal(full, data) {
+		t.Fatal("bad reassembly")
+	}
+	if len(c.transfers) != 0 {
+		t.Fatal("transfer must be removed")
+	}
+	// 收齐以后的数据可以突破 MAX_PKG 读出 Message
+	m, err := new(Message).FromReader(&chunkRW{Reader: bytes.NewReader(full)})
+	if err != nil || m.(*Message).Payload.Content != msg.Payload.Content {
+		t.Fatal("bad message", err)
+	}
+	if _, err = new(Message).FromReader(bytes.NewReader(full)); err == nil {
+		t.Fatal("stream must be limited by MAX_PKG")
+	}
+
+	bad := splitChunks(PID_NORMAL, data)
+	bad[1].Data = append([]byte{}, bad[1].Data...)
+	bad[1].Data[0] ^= 0xff
+	var last error
+	for _, chunk := range bad {
+		_, _, last = c.put(testMember1.Peerid(), chunk)
+	}
+	if last == nil {
+		t.Fatal("bad hash must fail")
+	}
+	if _, _, err = c.put(testMember1.Peerid(), &Chunk{Id: "x", Pid: PID_RTP, Total: 2, Data: []byte("x")}); err == nil {
+		t.Fatal("pid not registered must fail")
+	}
+}
@@ -0,0 +1,152 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"github.com/cc14514/go-alibp2p"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"io"
+)
+
+/*
+端到端加密，只用于 NormalMsg：
+用接收人 jid 中 peerid 对应的 secp256k1 公钥和一个临时私钥做 ECDH，
+sha256(shared.X + epk) 作为 AES-256-GCM 的密钥，Envelope.Id 作为附加数据，
+密文用 base64 放在 Payload.Content 中，临时公钥和 nonce 放在 Payload.Attrs 中
+*/
+
+const (
+	E2E_ATTR       = "e2e"
+	E2E_EPK_ATTR   = "e2e_epk"
+	E2E_NONCE_ATTR = "e2e_nonce"
+
+	E2E_SECP256K1_AESGCM = "secp256k1-aes256gcm"
+
+	// 解密失败时代替原消息的 SysMsg 的 event ，envelope.id 和 from 与原消息相同
+	E2E_FAILED_EVENT = "decrypt-failed"
+	E2E_ERROR_ATTR   = "error"
+)
+
+var errNotE2EMsg = errors.New("not e2e message")
+
+func decryptFailedMsg(msg *Message, err error) *Message {
+	sys := NewSysMessage(msg.Envelope.Id,
+		Attr{Key: SYNC_EVENT_ATTR, Val: E2E_FAILED_EVENT},
+		Attr{Key: SYNC_MSGID_ATTR, Val: msg.Envelope.Id},
+		Attr{Key: E2E_ERROR_ATTR, Val: err.Error()})
+	sys.Envelope.From, sys.Envelope.Ct = msg.Envelope.From, msg.Envelope.Ct
+	return sys
+}
+
+func e2eKey(priv *ecdsa.PrivateKey, pub *ecdsa.PublicKey, epk []byte) []byte {
+	x, _ := priv.Curve.ScalarMult(pub.X, pub.Y, priv.D.Bytes())
+	h := sha256.New()
+	h.Write(x.Bytes())
+	h.Write(epk)
+	return h.Sum(nil)
+}
+
+func e2eAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func IsE2EMsg(msg *Message) bool {
+	_, ok := msg.Payload.GetAttr(E2E_ATTR)
+	return ok
+}
+
+// 返回加密后的副本，不修改 msg
+func EncryptMsg(msg *Message) (*Message, error) {
+	if msg.Envelope.Type != NormalMsg {
+		return nil, errors.New("e2e only support normal message")
+	}
+	pub, err := alibp2p.ECDSAPubDecode(msg.Envelope.To.Peerid())
+	if err != nil {
+		return nil, err
+	}
+	k, _, err := crypto.GenerateSecp256k1Key(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	epk, err := k.GetPublic().Raw()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := e2eAEAD(e2eKey((*ecdsa.PrivateKey)(k.(*crypto.Secp256k1PrivateKey)), pub, epk))
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	ct := aead.Seal(nil, nonce, []byte(msg.Payload.Content), []byte(msg.Envelope.Id))
+
+	cpy := *msg
+	cpy.Payload.Attrs = append([]Attr{}, msg.Payload.Attrs...)
+	cpy.Payload.Content = base64.StdEncoding.EncodeToString(ct)
+	cpy.Payload.SetAttr(E2E_ATTR, E2E_SECP256K1_AESGCM)
+	cpy.Payload.SetAttr(E2E_EPK_ATTR, base64.StdEncoding.EncodeToString(epk))
+	cpy.Payload.SetAttr(E2E_NONCE_ATTR, base64.StdEncoding.EncodeToString(nonce))
+	return &cpy, nil
+}
+
+// 用本节点私钥解密，成功后 Content 为明文，只保留 e2e 属性用于标记
+func DecryptMsg(key *ecdsa.PrivateKey, msg *Message) error {
+	alg, ok := msg.Payload.GetAttr(E2E_ATTR)
+	if !ok {
+		return errNotE2EMsg
+	}
+	if alg != E2E_SECP256K1_AESGCM {
+		return errors.New("e2e algorithm not support")
+	}
+	if key == nil {
+		return errors.New("nodekey not found")
+	}
+	var (
+		epkAttr, _   = msg.Payload.GetAttr(E2E_EPK_ATTR)
+		nonceAttr, _ = msg.Payload.GetAttr(E2E_NONCE_ATTR)
+	)
+	epk, err := base64.StdEncoding.DecodeString(epkAttr)
+	if err != nil {
+		return err
+	}
+	nonce, err := base64.StdEncoding.DecodeString(nonceAttr)
+	if err != nil {
+		return err
+	}
+	ct, err := base64.StdEncoding.DecodeString(msg.Payload.Content)
+	if err != nil {
+		return err
+	}
+	pk, err := crypto.UnmarshalSecp256k1PublicKey(epk)
+	if err != nil {
+		return err
+	}
+	aead, err := e2eAEAD(e2eKey(key, (*ecdsa.PublicKey)(pk.(*crypto.Secp256k1PublicKey)), epk))
+	if err != nil {
+		return err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return errors.New("bad e2e nonce")
+	}
+	plain, err := aead.Open(nil, nonce, ct, []byte(msg.Envelope.Id))
+	if err != nil {
+		return err
+	}
+	msg.Payload.Content = string(plain)
+	msg.Payload.DelAttr(E2E_EPK_ATTR, E2E_NONCE_ATTR)
+	return nil
+}
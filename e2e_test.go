@@ -0,0 +1,54 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"testing"
+)
+
+func TestE2E(t *testing.T) {
+	var (
+		key, id  = newTestKey(t)
+		other, _ = newTestKey(t)
+		_, from  = newTestKey(t)
+		msg      = NewNormalMessage(JID(from), JID(id), "hello world", Attr{Key: "k", Val: "v"})
+	)
+	emsg, err := EncryptMsg(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsE2EMsg(emsg) || IsE2EMsg(msg) || emsg.Payload.Content == msg.Payload.Content {
+		t.Fatal("bad encrypted message", emsg)
+	}
+	failed := copyMsg(emsg)
+	if err := DecryptMsg(other, failed); err == nil {
+		t.Fatal("other key must not decrypt")
+	} else if sys := decryptFailedMsg(failed, err); sys.Envelope.Type != SysMsg || sys.Envelope.Id != emsg.Envelope.Id ||
+		sys.Payload.Content != "" || IsE2EMsg(sys) {
+		t.Fatal("ciphertext must not be delivered", sys)
+	}
+	tampered := copyMsg(emsg)
+	tampered.Envelope.Id = "other"
+	if err := DecryptMsg(key, tampered); err == nil {
+		t.Fatal("envelope id is authenticated")
+	}
+	if err := DecryptMsg(key, emsg); err != nil {
+		t.Fatal(err)
+	}
+	if emsg.Payload.Content != "hello world" {
+		t.Fatal("bad content", emsg.Payload.Content)
+	}
+	if v, ok := emsg.Payload.GetAttr("k"); !ok || v != "v" {
+		t.Fatal("attrs must be kept", emsg.Payload.Attrs)
+	}
+	if _, ok := emsg.Payload.GetAttr(E2E_EPK_ATTR); ok {
+		t.Fatal("epk must be removed", emsg.Payload.Attrs)
+	}
+}
+
+func copyMsg(msg *Message) *Message {
+	cpy := *msg
+	cpy.Payload.Attrs = append([]Attr{}, msg.Payload.Attrs...)
+	return &cpy
+}
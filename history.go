@@ -0,0 +1,116 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"encoding/binary"
+	"github.com/cc14514/go-achat-node/ldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"log"
+	"path"
+	"time"
+)
+
+/*
+本地聊天记录，只保存 NormalMsg 和 GroupMsg ，加密消息保存解密后的内容：
+key = conversation + "_" + ct(8 字节大端) + msgid ，
+conversation 单聊为对方的 peerid ，群聊为 gid ，同一条消息重复写入会覆盖
+*/
+
+const (
+	defHistoryQueryLimit = 20
+	maxHistoryQueryLimit = 200
+)
+
+type history struct {
+	db *ldb.LDBDatabase
+}
+
+func newHistory(homedir string) *history {
+	db, err := ldb.NewLDBDatabase(path.Join(homedir, "history"), 0, 0)
+	if err != nil {
+		panic(err)
+	}
+	return &history{db: db}
+}
+
+func historyPrefix(conv string) []byte {
+	return []byte(conv + "_")
+}
+
+func historyK(conv string, ct int64, id string) []byte {
+	k := historyPrefix(conv)
+	k = binary.BigEndian.AppendUint64(k, uint64(ct))
+	return append(k, []byte(id)...)
+}
+
+// 消息所属的会话，myid 为本节点 peerid
+func conversation(myid string, msg *Message) string {
+	switch msg.Envelope.Type {
+	case NormalMsg:
+		if msg.Envelope.From.Peerid() == myid {
+			return msg.Envelope.To.Peerid()
+		}
+		return msg.Envelope.From.Peerid()
+	case GroupMsg:
+		return string(msg.Envelope.Gid)
+	}
+	return ""
+}
+
+func (h *history) put(myid string, msg *Message) error {
+	conv := conversation(myid, msg)
+	if conv == "" {
+		return nil
+	}
+	return h.db.Put(historyK(conv, msg.Envelope.Ct, msg.Envelope.Id), msg.Bytes())
+}
+
+// 返回 ct 小于 before 的消息，按时间倒序；before <= 0 时从最新一条开始，
+// 为了用 ct 翻页不丢消息，最后一条消息同一秒内的消息会一起返回，所以结果可能多于 limit
+func (h *history) query(conv string, before int64, limit int) []*Message {
+	if limit <= 0 {
+		limit = defHistoryQueryLimit
+	}
+	if limit > maxHistoryQueryLimit {
+		limit = maxHistoryQueryLimit
+	}
+	if before <= 0 {
+		before = time.Now().Unix() + 1
+	}
+	rng := &util.Range{Start: historyPrefix(conv), Limit: historyK(conv, before, "")}
+	it := h.db.LDB().NewIterator(rng, nil)
+	defer it.Release()
+	ml := make([]*Message, 0)
+	for ok := it.Last(); ok; ok = it.Prev() {
+		msg, err := new(Message).FromBytes(it.Value())
+		if err != nil {
+			log.Println("history query error", "conv", conv, "err", err)
+			continue
+		}
+		m := msg.(*Message)
+		if len(ml) >= limit && m.Envelope.Ct != ml[len(ml)-1].Envelope.Ct {
+			break
+		}
+		ml = append(ml, m)
+	}
+	return ml
+}
+
+// 记录收发的消息，失败只打印日志
+func (c *ChatService) saveHistory(msg *Message) {
+	if err := c.history.put(c.myid.Peerid(), msg); err != nil {
+		log.Println("saveHistory error", "id", msg.Envelope.Id, "err", err)
+	}
+}
+
+// 查询与 jid 的单聊记录
+func (c *ChatService) History(jid JID, before int64, limit int) []*Message {
+	return c.history.query(jid.Peerid(), before, limit)
+}
+
+// 查询本地保存的群 gid 聊天记录
+func (c *ChatService) LocalGroupHistory(gid GID, before int64, limit int) []*Message {
+	return c.history.query(string(gid), before, limit)
+}
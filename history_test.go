@@ -0,0 +1,49 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	h := newHistory(t.TempDir())
+	t.Cleanup(h.db.Close)
+	me := testOwner.Peerid()
+	put := func(msg *Message, ct int64) {
+		msg.Envelope.Ct = ct
+		if err := h.put(me, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(NewNormalMessage(testOwner, testMember1, "1"), 100)
+	put(NewNormalMessage(testMember1, testOwner, "2"), 101)
+	put(NewNormalMessage(testOwner, testMember1, "3"), 101)
+	put(NewNormalMessage(testOwner, testMember1, "4"), 102)
+	put(NewNormalMessage(testOwner, testMember2, "x"), 103)
+	put(NewGroupMessage(testOwner, testGid, "g"), 104)
+	put(NewSyncMessage(testMember1, testOwner, SYNC_READ, "id"), 105)
+
+	c := &ChatService{history: h}
+	// 带 mailbox 的 jid 与 gid 长度相同，按调用的方法区分
+	ml := c.History(testMember1, 0, 10)
+	if len(ml) != 4 || ml[0].Payload.Content != "4" || ml[3].Payload.Content != "1" {
+		t.Fatal("bad history", ml)
+	}
+	// 同一秒内的消息一起返回
+	ml = h.query(testMember1.Peerid(), 0, 2)
+	if len(ml) != 3 || ml[2].Envelope.Ct != 101 {
+		t.Fatal("bad page", ml)
+	}
+	ml = h.query(testMember1.Peerid(), ml[len(ml)-1].Envelope.Ct, 2)
+	if len(ml) != 1 || ml[0].Payload.Content != "1" {
+		t.Fatal("bad next page", ml)
+	}
+	if ml = c.LocalGroupHistory(testGid, 0, 10); len(ml) != 1 || ml[0].Payload.Content != "g" {
+		t.Fatal("bad group history", ml)
+	}
+	if ml = c.History(JID(testGid), 0, 10); len(ml) != 0 {
+		t.Fatal("gid must not be read as jid", ml)
+	}
+}
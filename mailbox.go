@@ -4,8 +4,10 @@
 package chat
 
 import (
+	"bytes"
 	"context"
 	"crypto/ecdsa"
+	"encoding/binary"
 	"errors"
 	"github.com/cc14514/go-achat-node/ldb"
 	"github.com/cc14514/go-alibp2p"
@@ -14,18 +16,44 @@ import (
 	"log"
 	"path"
 	"sort"
+	"sync"
+	"time"
 )
 
-// TODO 映射绑定关系即 jid + mailboxid ，接受指令时要验证 jid
+const (
+	defQueryPageLimit = 50
+	maxQueryPageLimit = 200
+	maxQueryPageBytes = 32 * MAX_PKG
+
+	// 分页查询用的索引 "MSGCT" + peerid + ct(8 字节大端) + msgid ，在 putMsg 和删除消息时更新
+	msgct_prefix = "MSGCT"
+	msgct_ready  = "MSGCT_READY" // 已经为旧版本保存的消息建过索引
+)
+
+func msgctK(peerid string, ct int64, msgid string) []byte {
+	k := binary.BigEndian.AppendUint64(append([]byte(msgct_prefix), []byte(peerid)...), uint64(ct))
+	return append(k, []byte(msgid)...)
+}
+
+// jid 通过 PID_MAILBOX_BIND 注册绑定关系即 jid + mailboxid ，接受指令时要验证 jid
 type mailbox struct {
 	myid       JID
 	ctx        context.Context
 	stop       chan struct{}
 	db         ldb.Database
 	p2pservice alibp2p.Libp2pService
+	chunks     *chunker
+	blobs      *blobStore    // 代存的 blob
+	ttl        time.Duration // 离线消息的有效期
+	notify     bool          // 消息过期时是否通知发送人
+	open       bool          // 接收没有注册的 jid 的离线消息
+	maxCount   int64         // 每个接收人最多保存的条数
+	maxBytes   int64         // 每个接收人最多保存的字节数
+	limiter    *limiter      // 每个发送人的写入速率
+	lock       sync.Mutex
 }
 
-func newMailbox(ctx context.Context, homedir string, myid JID, p2pservice alibp2p.Libp2pService) *mailbox {
+func newMailbox(ctx context.Context, homedir string, myid JID, p2pservice alibp2p.Libp2pService, chunks *chunker) *mailbox {
 	db, err := ldb.NewLDBDatabase(path.Join(homedir, "mailbox"), 0, 0)
 	if err != nil {
 		panic(err)
@@ -36,36 +64,92 @@ func newMailbox(ctx context.Context, homedir string, myid JID, p2pservice alibp2
 		stop:       make(chan struct{}),
 		db:         db,
 		p2pservice: p2pservice,
+		chunks:     chunks,
+		blobs:      newBlobStore(path.Join(homedir, "mailbox_blob")),
+		ttl:        defMailboxTTL,
+		maxCount:   defMailboxMaxCount,
+		maxBytes:   defMailboxMaxBytes,
+		limiter:    newLimiter(defSenderRate, defSenderBurst),
 	}
 }
 
+// 只接收已经注册过的 jid 的、验签通过的消息
 func (m *mailbox) verifyMsg(msg *Message) error {
-	// TODO 验证绑定关系
-	log.Println("TODO 验证绑定关系", msg)
-	return nil
+	if !m.accepts(msg.Envelope.To.Peerid()) {
+		return errNotRegistered
+	}
+	return msg.Verify()
 }
 
+// 超出接收人的限额时返回 ErrMailboxFull ，重复写入同一条消息只计算一次
 func (m *mailbox) putMsg(msg *Message) error {
-	id := msg.Envelope.To.Peerid()
-	tab := ldb.NewTable(m.db, id)
-	return tab.Put([]byte(msg.Envelope.Id), msg.Bytes())
+	var (
+		id          = msg.Envelope.To.Peerid()
+		tab         = ldb.NewTable(m.db, id)
+		data        = msg.Bytes()
+		count, size = int64(1), int64(len(data))
+	)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if old, err := tab.Get([]byte(msg.Envelope.Id)); err == nil {
+		count, size = 0, size-int64(len(old))
+	}
+	if m.overQuota(id, count, size) {
+		return ErrMailboxFull
+	}
+	if err := tab.Put([]byte(msg.Envelope.Id), data); err != nil {
+		return err
+	}
+	if err := m.addBlobRef(msg); err != nil {
+		return err
+	}
+	if err := m.addUsage(id, count, size); err != nil {
+		return err
+	}
+	// 重复写入时保留第一次的过期时间，不再增加索引
+	if count == 0 {
+		return nil
+	}
+	if err := m.db.Put(msgctK(id, msg.Envelope.Ct, msg.Envelope.Id), nil); err != nil {
+		return err
+	}
+	return m.putExpire(msg, time.Now())
+}
+
+// 删除一条消息并更新限额，返回删除的内容，消息不存在时返回 nil
+func (m *mailbox) delMsg(peerid, msgid string) []byte {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	tab := ldb.NewTable(m.db, peerid)
+	buf, err := tab.Get([]byte(msgid))
+	if err != nil {
+		return nil
+	}
+	if err = tab.Delete([]byte(msgid)); err != nil {
+		return nil
+	}
+	m.addUsage(peerid, -1, -int64(len(buf)))
+	m.delBlobRef(peerid, buf)
+	if msg, err := new(Message).FromBytes(buf); err == nil {
+		m.db.Delete(msgctK(peerid, msg.(*Message).Envelope.Ct, msgid))
+	}
+	return buf
 }
 
 func (m *mailbox) doCleanMsg(cleanMsg *CleanMsg) {
 	id := cleanMsg.Jid.Peerid()
-	tab := ldb.NewTable(m.db, id)
 	for _, mid := range cleanMsg.Ids {
-		tab.Delete([]byte(mid))
+		m.delMsg(id, mid)
 	}
 }
 
 func (m *mailbox) doQueryMsg(jid JID) *MessageBag {
-	id := jid.Peerid()
-	tab := ldb.NewTable(m.db, id)
-	it := tab.NewIterator()
+	prefix := []byte(jid.Peerid())
+	it := m.db.NewIterator()
+	defer it.Release()
 	sl := make([]*Message, 0)
-	for it.Next() {
-		if ldb.Kfilter([]byte(id), it.Key()) {
+	for ok := it.Seek(prefix); ok && bytes.HasPrefix(it.Key(), prefix); ok = it.Next() {
+		if ldb.Kfilter(prefix, it.Key()) {
 			if m, err := new(Message).FromBytes(it.Value()); err == nil {
 				sl = append(sl, m.(*Message))
 			}
@@ -76,26 +160,100 @@ func (m *mailbox) doQueryMsg(jid JID) *MessageBag {
 	return &MessageBag{Messages: ml}
 }
 
+// (q.Ct, q.Id) 之后的一页，按 MSGCT 索引顺序读取，按条数和字节数截断，至少返回一条
+func (m *mailbox) doQueryPage(q *MailboxQuery) *MessageBag {
+	limit := q.Limit
+	if limit <= 0 || limit > maxQueryPageLimit {
+		limit = defQueryPageLimit
+	}
+	var (
+		id     = q.Jid.Peerid()
+		tab    = ldb.NewTable(m.db, id)
+		prefix = []byte(msgct_prefix + id)
+		from   = msgctK(id, q.Ct, q.Id)
+		page   = make(MessageList, 0)
+		size   int
+		it     = m.db.NewIterator()
+	)
+	defer it.Release()
+	ok := it.Seek(from)
+	if ok && bytes.Equal(it.Key(), from) {
+		ok = it.Next()
+	}
+	for ; ok && bytes.HasPrefix(it.Key(), prefix); ok = it.Next() {
+		k := it.Key()
+		if len(k) < len(prefix)+8 {
+			continue
+		}
+		buf, err := tab.Get(k[len(prefix)+8:])
+		if err != nil {
+			continue
+		}
+		if len(page) >= limit || (len(page) > 0 && size+len(buf) > maxQueryPageBytes) {
+			return &MessageBag{Messages: page, More: true}
+		}
+		msg := new(Message)
+		if _, err := msg.FromBytes(buf); err != nil {
+			continue
+		}
+		page, size = append(page, msg), size+len(buf)
+	}
+	return &MessageBag{Messages: page}
+}
+
+// 为旧版本保存的、没有 MSGCT 索引的消息建索引，只执行一次
+func (m *mailbox) indexMsgCt() {
+	if ok, _ := m.db.Has([]byte(msgct_ready)); ok {
+		return
+	}
+	keys := make([][]byte, 0)
+	it := m.db.NewIterator()
+	for it.Next() {
+		msg := new(Message)
+		if _, err := msg.FromBytes(it.Value()); err != nil {
+			continue
+		}
+		id := msg.Envelope.To.Peerid()
+		if string(it.Key()) == id+msg.Envelope.Id {
+			keys = append(keys, msgctK(id, msg.Envelope.Ct, msg.Envelope.Id))
+		}
+	}
+	it.Release()
+	for _, k := range keys {
+		m.db.Put(k, nil)
+	}
+	m.db.Put([]byte(msgct_ready), nil)
+	log.Println("mailbox indexMsgCt", "count", len(keys))
+}
+
 func (m *mailbox) Stop() error {
 	close(m.stop)
 	return nil
 }
 
 func (m *mailbox) Start() error {
+	m.indexMsgCt()
+	m.bindService()
 	m.queryService()
+	m.queryPageService()
 	m.msgService()
 	m.cleanService()
+	m.blobService()
+	go m.sweepLoop()
 	m.groupService()
 	return nil
 }
 
-func (m *mailbox) CleanMsg(jid JID, ids []string) error {
+func (m *mailbox) CleanMsg(mailid string, jid JID, ids []string) error {
 	data, err := amino.MarshalBinaryLengthPrefixed(&CleanMsg{jid, ids})
 	if err != nil {
 		return err
 	}
-	_, err = m.p2pservice.RequestWithTimeout(jid.Mailid(), PID_MAILBOX_CLEAN, data, timeout)
-	return err
+	rtn, err := m.p2pservice.RequestWithTimeout(mailid, PID_MAILBOX_CLEAN, data, timeout)
+	if err != nil {
+		return err
+	}
+	return readRsp(rtn)
 }
 
 func (m *mailbox) cleanService() {
@@ -104,63 +262,126 @@ func (m *mailbox) cleanService() {
 		_, err := amino.UnmarshalBinaryLengthPrefixedReader(rw, cleanMsg, 2*1024*1024)
 		if err != nil {
 			log.Println("PID_MAILBOX_CLEAN error", "err", err)
+			writeRsp(rw, RSP_BAD_REQUEST, err)
+			return err
+		}
+		if cleanMsg.Jid, err = m.verifyOwner(pubkey, cleanMsg.Jid); err != nil {
+			log.Println("PID_MAILBOX_CLEAN error", "session", sessionId, "err", err)
+			writeRsp(rw, rspCode(err), err)
 			return err
 		}
 		m.doCleanMsg(cleanMsg)
+		return writeRsp(rw, RSP_OK, nil)
+	})
+}
+
+// 一次返回全部离线消息，消息多时会超过 MAX_PKG ，只为旧版本保留，新版本用 PID_MAILBOX_PAGE
+func (m *mailbox) queryService() {
+	m.p2pservice.SetHandler(PID_MAILBOX_QUERY, func(sessionId string, pubkey *ecdsa.PublicKey, rw io.ReadWriter) error {
+		var k JID
+		_, err := amino.UnmarshalBinaryLengthPrefixedReader(rw, &k, 128)
+		if err != nil {
+			log.Println("PID_MAILBOX_QUERY error", "err", err)
+			rw.Write(new(MessageBag).setErr(RSP_BAD_REQUEST, err).Bytes())
+			return err
+		}
+		if k, err = m.verifyOwner(pubkey, k); err != nil {
+			log.Println("PID_MAILBOX_QUERY error", "session", sessionId, "err", err)
+			rw.Write(new(MessageBag).setErr(rspCode(err), err).Bytes())
+			return err
+		}
+		_, err = rw.Write(m.doQueryMsg(k).Bytes())
 		return err
 	})
 }
 
-func (m *mailbox) QueryMsg(jid JID) (*MessageBag, error) {
-	data, err := amino.MarshalBinaryLengthPrefixed(jid)
+// 旧版本的 mailbox 没有 PID_MAILBOX_PAGE ，一次取回全部离线消息
+func (m *mailbox) QueryMsg(mailid string, jid JID) (*MessageBag, error) {
+	rtn, err := m.p2pservice.RequestWithTimeout(mailid, PID_MAILBOX_QUERY, mustToByte(jid), timeout)
 	if err != nil {
 		return nil, err
 	}
-	rtn, err := m.p2pservice.RequestWithTimeout(jid.Mailid(), PID_MAILBOX_QUERY, data, timeout)
+	var msgs = new(MessageBag)
+	if err = amino.UnmarshalBinaryLengthPrefixed(rtn, msgs); err != nil {
+		return nil, err
+	}
+	if err = msgs.error(); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+func (m *mailbox) QueryPage(mailid string, q *MailboxQuery) (*MessageBag, error) {
+	rtn, err := m.p2pservice.RequestWithTimeout(mailid, PID_MAILBOX_PAGE, mustToByte(q), timeout)
 	if err != nil {
 		return nil, err
 	}
 	var msgs = new(MessageBag)
-	err = amino.UnmarshalBinaryLengthPrefixed(rtn, msgs)
-	return msgs, err
+	if err = amino.UnmarshalBinaryLengthPrefixed(rtn, msgs); err != nil {
+		return nil, err
+	}
+	if err = msgs.error(); err != nil {
+		return nil, err
+	}
+	return msgs, nil
 }
 
-func (m *mailbox) queryService() {
-	m.p2pservice.SetHandler(PID_MAILBOX_QUERY, func(sessionId string, pubkey *ecdsa.PublicKey, rw io.ReadWriter) error {
-		var k JID
-		_, err := amino.UnmarshalBinaryLengthPrefixedReader(rw, &k, 128)
+func (m *mailbox) queryPageService() {
+	m.p2pservice.SetHandler(PID_MAILBOX_PAGE, func(sessionId string, pubkey *ecdsa.PublicKey, rw io.ReadWriter) error {
+		q := new(MailboxQuery)
+		_, err := amino.UnmarshalBinaryLengthPrefixedReader(rw, q, 512)
 		if err != nil {
-			log.Println("PID_MAILBOX_QUERY error", "err", err)
-			rw.Write(new(MessageBag).Bytes())
+			log.Println("PID_MAILBOX_PAGE error", "err", err)
+			rw.Write(new(MessageBag).setErr(RSP_BAD_REQUEST, err).Bytes())
 			return err
 		}
-		_, err = rw.Write(m.doQueryMsg(k).Bytes())
+		if q.Jid, err = m.verifyOwner(pubkey, q.Jid); err != nil {
+			log.Println("PID_MAILBOX_PAGE error", "session", sessionId, "err", err)
+			rw.Write(new(MessageBag).setErr(rspCode(err), err).Bytes())
+			return err
+		}
+		_, err = rw.Write(m.doQueryPage(q).Bytes())
 		return err
 	})
 }
 
 func (m *mailbox) msgService() {
-	m.p2pservice.SetHandler(PID_MAILBOX, func(sessionId string, pubkey *ecdsa.PublicKey, rw io.ReadWriter) error {
+	m.chunks.SetHandler(PID_MAILBOX, func(sessionId string, pubkey *ecdsa.PublicKey, rw io.ReadWriter) error {
 		msg, err := new(Message).FromReader(rw)
 		if err != nil {
-			rw.Write([]byte(err.Error()))
+			writeRsp(rw, RSP_BAD_REQUEST, err)
 			return err
 		}
 		message := msg.(*Message)
 		if err := m.verifyMsg(message); err != nil {
-			rw.Write([]byte(err.Error()))
+			code := RSP_UNAUTHORIZED
+			if errors.Is(err, errNotRegistered) {
+				code = RSP_NOT_REGISTERED
+			}
+			writeRsp(rw, code, err)
+			return err
+		}
+		from, _ := alibp2p.ECDSAPubEncode(pubkey)
+		if err := m.allowSender(from); err != nil {
+			log.Println("PID_MAILBOX error", "session", sessionId, "from", from, "err", err)
+			writeRsp(rw, RSP_RATE_LIMITED, err)
 			return err
 		}
 		switch message.Envelope.Type {
-		case NormalMsg, GroupMsg:
+		case NormalMsg, GroupMsg, SyncMsg:
 			if err := m.putMsg(msg.(*Message)); err != nil {
-				rw.Write([]byte(err.Error()))
+				code := RSP_INTERNAL
+				if errors.Is(err, ErrMailboxFull) {
+					code = RSP_MAILBOX_FULL
+				}
+				writeRsp(rw, code, err)
 				return err
 			}
 		default:
-			return errors.New("not support yet")
+			err := errors.New("not support yet")
+			writeRsp(rw, RSP_NOT_SUPPORT, err)
+			return err
 		}
-		rw.Write(SUCCESS)
-		return nil
+		return writeRsp(rw, RSP_OK, nil)
 	})
 }
@@ -0,0 +1,146 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/cc14514/go-achat-node/ldb"
+	"github.com/cc14514/go-alibp2p"
+	"github.com/tendermint/go-amino"
+	"io"
+	"log"
+	"time"
+)
+
+const bind_prefix = "BIND"
+
+// 注册请求的 Ct 与本地时间最多相差这么多，防止截获的注册被重放
+var bindMaxSkew = 10 * time.Minute
+
+var (
+	errNotRegistered = errors.New("recipient not registered")
+	errStaleBind     = errors.New("stale bind")
+)
+
+// jid 向 mailbox 注册绑定关系，Sig 是 jid 对应的节点私钥对 (Jid + Ct) 的签名
+type MailboxBind struct {
+	Jid JID
+	Ct  int64
+	Sig []byte
+}
+
+func (b *MailboxBind) hash() []byte {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s%d", b.Jid, b.Ct)))
+	return h[:]
+}
+
+func (b *MailboxBind) Sign(key *ecdsa.PrivateKey) error {
+	sig, err := signHash(key, b.hash())
+	if err != nil {
+		return err
+	}
+	b.Sig = sig
+	return nil
+}
+
+// 签名必须能用 jid 中的 peerid 验证
+func (b *MailboxBind) Verify() error {
+	return verifyHash(b.Jid.Peerid(), b.hash(), b.Sig)
+}
+
+func (m *mailbox) bindTab() ldb.Database {
+	return ldb.NewTable(m.db, bind_prefix)
+}
+
+func (m *mailbox) saveBind(b *MailboxBind) error {
+	return m.bindTab().Put([]byte(b.Jid.Peerid()), mustToByte(b))
+}
+
+func (m *mailbox) isBound(peerid string) bool {
+	ok, _ := m.bindTab().Has([]byte(peerid))
+	return ok
+}
+
+// 打开 open 时也替没有注册的旧版本客户端保存离线消息
+func (m *mailbox) accepts(peerid string) bool {
+	return m.open || m.isBound(peerid)
+}
+
+// 校验注册请求，caller 为连接的 peerid ，返回的错误码用于 writeRsp
+func (m *mailbox) verifyBind(caller string, b *MailboxBind, now time.Time) (int, error) {
+	if b.Jid.Peerid() == "" || b.Jid.Peerid() != caller {
+		return RSP_FORBIDDEN, errPermissionDenied
+	}
+	if !b.Jid.HasMailid(m.myid.Peerid()) {
+		return RSP_BAD_REQUEST, errors.New("mailbox not match")
+	}
+	if err := b.Verify(); err != nil {
+		return RSP_UNAUTHORIZED, err
+	}
+	if d := now.Sub(time.Unix(b.Ct, 0)); d > bindMaxSkew || d < -bindMaxSkew {
+		return RSP_BAD_REQUEST, errStaleBind
+	}
+	// 不能用更早的注册覆盖
+	if buf, err := m.bindTab().Get([]byte(caller)); err == nil {
+		old := new(MailboxBind)
+		if amino.UnmarshalBinaryLengthPrefixed(buf, old) == nil && old.Ct > b.Ct {
+			return RSP_BAD_REQUEST, errStaleBind
+		}
+	}
+	return RSP_OK, nil
+}
+
+// 身份从连接的 pubkey 得到，不信任请求中的 jid；只有绑定过的 jid 本人可以查询和清理自己的离线消息
+func (m *mailbox) verifyOwner(pubkey *ecdsa.PublicKey, jid JID) (JID, error) {
+	caller, err := alibp2p.ECDSAPubEncode(pubkey)
+	if err != nil {
+		return "", err
+	}
+	if jid != "" && jid.Peerid() != caller {
+		return "", errPermissionDenied
+	}
+	if !m.accepts(caller) {
+		return "", errNotRegistered
+	}
+	return JID(caller), nil
+}
+
+// 把 jid 注册到它的 mailbox 上，注册以后 mailbox 才会替它接收离线消息
+func (m *mailbox) Bind(mailid string, jid JID) error {
+	b := &MailboxBind{Jid: jid, Ct: time.Now().Unix()}
+	if err := b.Sign(m.p2pservice.Nodekey()); err != nil {
+		return err
+	}
+	rtn, err := m.p2pservice.RequestWithTimeout(mailid, PID_MAILBOX_BIND, mustToByte(b), timeout)
+	if err != nil {
+		return err
+	}
+	return readRsp(rtn)
+}
+
+func (m *mailbox) bindService() {
+	m.p2pservice.SetHandler(PID_MAILBOX_BIND, func(sessionId string, pubkey *ecdsa.PublicKey, rw io.ReadWriter) error {
+		b := new(MailboxBind)
+		_, err := amino.UnmarshalBinaryLengthPrefixedReader(rw, b, MAX_PKG)
+		if err != nil {
+			writeRsp(rw, RSP_BAD_REQUEST, err)
+			return err
+		}
+		caller, _ := alibp2p.ECDSAPubEncode(pubkey)
+		if code, err := m.verifyBind(caller, b, time.Now()); err != nil {
+			log.Println("PID_MAILBOX_BIND error", "jid", b.Jid, "caller", caller, "err", err)
+			writeRsp(rw, code, err)
+			return err
+		}
+		if err = m.saveBind(b); err != nil {
+			writeRsp(rw, RSP_INTERNAL, err)
+			return err
+		}
+		log.Println("PID_MAILBOX_BIND", "jid", b.Jid)
+		return writeRsp(rw, RSP_OK, nil)
+	})
+}
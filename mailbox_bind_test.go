@@ -0,0 +1,126 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"github.com/cc14514/go-achat-node/ldb"
+	"github.com/cc14514/go-alibp2p"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"testing"
+	"time"
+)
+
+func newTestKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	priv, _, err := crypto.GenerateSecp256k1Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := (*ecdsa.PrivateKey)(priv.(*crypto.Secp256k1PrivateKey))
+	id, err := alibp2p.ECDSAPubEncode(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, id
+}
+
+func newTestMailbox(t *testing.T) *mailbox {
+	db, err := ldb.NewLDBDatabase(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	_, id := newTestKey(t)
+	return &mailbox{myid: JID(id), db: db, blobs: newBlobStore(t.TempDir()), stop: make(chan struct{})}
+}
+
+func TestMailboxBind(t *testing.T) {
+	var (
+		m             = newTestMailbox(t)
+		key, id       = newTestKey(t)
+		sender, other = newTestKey(t)
+		b             = &MailboxBind{Jid: NewJID(id, m.myid.Peerid()), Ct: time.Now().Unix()}
+	)
+	if err := b.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	forged := &MailboxBind{Jid: NewJID(other, m.myid.Peerid()), Ct: b.Ct, Sig: b.Sig}
+	if err := forged.Verify(); err == nil {
+		t.Fatal("forged bind must not verify")
+	}
+
+	msg := NewNormalMessage(JID(other), b.Jid, "hello")
+	if err := msg.Sign(sender); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.verifyMsg(msg); err != errNotRegistered {
+		t.Fatal("unregistered recipient must be rejected", err)
+	}
+	if _, err := m.verifyOwner(&key.PublicKey, b.Jid); err != errNotRegistered {
+		t.Fatal("unregistered owner must be rejected", err)
+	}
+	if err := m.saveBind(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.verifyMsg(msg); err != nil {
+		t.Fatal(err)
+	}
+	if jid, err := m.verifyOwner(&key.PublicKey, b.Jid); err != nil || jid != JID(id) {
+		t.Fatal(jid, err)
+	}
+	if jid, err := m.verifyOwner(&key.PublicKey, ""); err != nil || jid != JID(id) {
+		t.Fatal("identity must be derived from pubkey", jid, err)
+	}
+	otherKey, _ := newTestKey(t)
+	if _, err := m.verifyOwner(&otherKey.PublicKey, b.Jid); err != errPermissionDenied {
+		t.Fatal("other pubkey must be rejected", err)
+	}
+
+	// 打开 open 以后没有注册的 jid 也可以
+	m2 := newTestMailbox(t)
+	m2.open = true
+	if err := m2.verifyMsg(msg); err != nil {
+		t.Fatal("open mailbox must accept unbound recipient", err)
+	}
+}
+
+func TestVerifyBind(t *testing.T) {
+	var (
+		m       = newTestMailbox(t)
+		key, id = newTestKey(t)
+		now     = time.Now()
+		newBind = func(ct time.Time) *MailboxBind {
+			b := &MailboxBind{Jid: NewJID(id, m.myid.Peerid()), Ct: ct.Unix()}
+			if err := b.Sign(key); err != nil {
+				t.Fatal(err)
+			}
+			return b
+		}
+		b = newBind(now)
+	)
+	if _, err := m.verifyBind(id, b, now); err != nil {
+		t.Fatal(err)
+	}
+	_, other := newTestKey(t)
+	if code, err := m.verifyBind(other, b, now); err != errPermissionDenied || code != RSP_FORBIDDEN {
+		t.Fatal("bind must come from the jid itself", code, err)
+	}
+	// 截获的注册过一段时间以后不能重放
+	if _, err := m.verifyBind(id, b, now.Add(bindMaxSkew+time.Minute)); err != errStaleBind {
+		t.Fatal("stale bind must be rejected", err)
+	}
+	if err := m.saveBind(b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.verifyBind(id, newBind(now.Add(-time.Minute)), now); err != errStaleBind {
+		t.Fatal("older bind must not replace newer one", err)
+	}
+	if _, err := m.verifyBind(id, newBind(now.Add(time.Minute)), now); err != nil {
+		t.Fatal(err)
+	}
+}
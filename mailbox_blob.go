@@ -0,0 +1,176 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"github.com/cc14514/go-alibp2p"
+	"github.com/tendermint/go-amino"
+	"io"
+	"log"
+	"time"
+)
+
+/*
+mailbox 代存的 blob 保存在 homedir/mailbox_blob ，与节点自己的 blob 分开：
+"MBLOB" + hash + peerid 记录替哪个接收人保存，大小计入接收人的限额；
+"MBREF" + hash + peerid + msgid 记录引用它的离线消息，在 putMsg 和删除消息时更新；
+接收人最后一条引用消息被删除（clean 或过期）时释放额度，没有接收人时删除文件，
+上传以后超过有效期仍没有消息引用的在 sweep 时清理；
+PID_BLOB 只把代存的 blob 返回给记录中的接收人
+*/
+
+const (
+	mblob_prefix = "MBLOB"
+	mbref_prefix = "MBREF"
+)
+
+type mailboxBlob struct {
+	Size int64
+	Ct   int64 // 开始上传的时间，秒
+}
+
+func mblobK(hash, peerid string) []byte {
+	return []byte(mblob_prefix + hash + peerid)
+}
+
+func mbrefK(hash, peerid, msgid string) []byte {
+	return []byte(mbref_prefix + hash + peerid + msgid)
+}
+
+func (m *mailbox) hasPrefix(prefix []byte) bool {
+	it := m.db.NewIterator()
+	defer it.Release()
+	return it.Seek(prefix) && bytes.HasPrefix(it.Key(), prefix)
+}
+
+// 第一次为接收人上传时占用额度，超出时返回 ErrMailboxFull
+func (m *mailbox) reserveBlob(put *BlobPut) error {
+	if !validBlobHash(put.Hash) {
+		return errBadBlobHash
+	}
+	peerid := put.To.Peerid()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if ok, _ := m.db.Has(mblobK(put.Hash, peerid)); ok {
+		return nil
+	}
+	if m.overQuota(peerid, 0, put.Size) {
+		return ErrMailboxFull
+	}
+	if err := m.db.Put(mblobK(put.Hash, peerid), mustToByte(&mailboxBlob{Size: put.Size, Ct: time.Now().Unix()})); err != nil {
+		return err
+	}
+	return m.addUsage(peerid, 0, put.Size)
+}
+
+// 只有接收人可以读取，其他人按不存在处理
+func (m *mailbox) readBlob(peerid string, req *BlobReq) (*BlobRsp, error) {
+	if !validBlobHash(req.Hash) {
+		return nil, errBlobNotFound
+	}
+	if ok, _ := m.db.Has(mblobK(req.Hash, peerid)); !ok {
+		return nil, errBlobNotFound
+	}
+	return m.blobs.read(req.Hash, req.Offset, req.Length)
+}
+
+// 调用时需要持有 m.lock
+func (m *mailbox) addBlobRef(msg *Message) error {
+	if b := BlobOf(msg); b != nil && validBlobHash(b.Hash) {
+		return m.db.Put(mbrefK(b.Hash, msg.Envelope.To.Peerid(), msg.Envelope.Id), nil)
+	}
+	return nil
+}
+
+// 删除消息的引用，接收人没有其他消息引用时释放，调用时需要持有 m.lock
+func (m *mailbox) delBlobRef(peerid string, buf []byte) {
+	msg := new(Message)
+	if _, err := msg.FromBytes(buf); err != nil {
+		return
+	}
+	b := BlobOf(msg)
+	if b == nil || !validBlobHash(b.Hash) {
+		return
+	}
+	m.db.Delete(mbrefK(b.Hash, peerid, msg.Envelope.Id))
+	if !m.hasPrefix(mbrefK(b.Hash, peerid, "")) {
+		m.releaseBlob(b.Hash, peerid)
+	}
+}
+
+// 调用时需要持有 m.lock
+func (m *mailbox) releaseBlob(hash, peerid string) {
+	buf, err := m.db.Get(mblobK(hash, peerid))
+	if err != nil {
+		return
+	}
+	mb := new(mailboxBlob)
+	amino.UnmarshalBinaryLengthPrefixed(buf, mb)
+	m.db.Delete(mblobK(hash, peerid))
+	m.addUsage(peerid, 0, -mb.Size)
+	if !m.hasPrefix([]byte(mblob_prefix + hash)) {
+		m.blobs.remove(hash)
+	}
+}
+
+// 清理超过有效期仍没有消息引用的 blob ，返回清理的个数
+func (m *mailbox) sweepBlobs(now time.Time) int {
+	var (
+		prefix = []byte(mblob_prefix)
+		n      = 0
+	)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	it := m.db.NewIterator()
+	keys := make([][]byte, 0)
+	for ok := it.Seek(prefix); ok && bytes.HasPrefix(it.Key(), prefix); ok = it.Next() {
+		mb := new(mailboxBlob)
+		if err := amino.UnmarshalBinaryLengthPrefixed(it.Value(), mb); err == nil && now.Sub(time.Unix(mb.Ct, 0)) <= m.ttl {
+			continue
+		}
+		keys = append(keys, append([]byte{}, it.Key()...))
+	}
+	it.Release()
+	for _, k := range keys {
+		if len(k) != len(prefix)+64+53 {
+			m.db.Delete(k)
+			continue
+		}
+		hash, peerid := string(k[len(prefix):len(prefix)+64]), string(k[len(prefix)+64:])
+		if !m.hasPrefix(mbrefK(hash, peerid, "")) {
+			m.releaseBlob(hash, peerid)
+			n++
+		}
+	}
+	return n
+}
+
+func (m *mailbox) blobService() {
+	m.p2pservice.SetHandler(PID_MAILBOX_BLOB, func(sessionId string, pubkey *ecdsa.PublicKey, rw io.ReadWriter) error {
+		put := new(BlobPut)
+		_, err := amino.UnmarshalBinaryLengthPrefixedReader(rw, put, blobRangeSize+1024)
+		code := RSP_BAD_REQUEST
+		if err == nil {
+			// 只替绑定过的 jid 保存，每个上传人写自己的 part 文件
+			from, _ := alibp2p.ECDSAPubEncode(pubkey)
+			if !m.accepts(put.To.Peerid()) {
+				err = errNotRegistered
+			} else if err = m.reserveBlob(put); err == nil {
+				_, err = m.blobs.write(from, put.Hash, put.Size, put.Offset, put.Data)
+			}
+			code = rspCode(err)
+			if err == errBadBlobHash {
+				code = RSP_BAD_REQUEST
+			}
+		}
+		if err != nil {
+			log.Println("PID_MAILBOX_BLOB error", "session", sessionId, "to", put.To, "hash", put.Hash, "err", err)
+			writeRsp(rw, code, err)
+			return err
+		}
+		return writeRsp(rw, RSP_OK, nil)
+	})
+}
@@ -0,0 +1,88 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func newTestBlobPut(to JID, size int) *BlobPut {
+	data := make([]byte, size)
+	rand.Read(data)
+	h := sha256.Sum256(data)
+	return &BlobPut{To: to, Hash: hex.EncodeToString(h[:]), Size: int64(size), Data: data}
+}
+
+func TestMailboxBlob(t *testing.T) {
+	var (
+		m        = newTestMailbox(t)
+		_, peer  = newTestKey(t)
+		_, other = newTestKey(t)
+		put      = newTestBlobPut(JID(peer), 1000)
+	)
+	m.ttl = time.Hour
+	if err := m.reserveBlob(put); err != nil {
+		t.Fatal(err)
+	}
+	if done, err := m.blobs.write("a", put.Hash, put.Size, 0, put.Data); err != nil || !done {
+		t.Fatal(done, err)
+	}
+	if u := m.usage(peer); u.Bytes != put.Size || u.Count != 0 {
+		t.Fatal("blob must be counted in quota", u)
+	}
+	if _, err := m.readBlob(other, &BlobReq{Hash: put.Hash}); err != errBlobNotFound {
+		t.Fatal("only the recipient can read", err)
+	}
+	if rsp, err := m.readBlob(peer, &BlobReq{Hash: put.Hash}); err != nil || rsp.Size != put.Size {
+		t.Fatal("recipient must read", err)
+	}
+
+	// 超出限额
+	m.maxBytes = put.Size + 10
+	if err := m.reserveBlob(newTestBlobPut(JID(peer), 100)); err != ErrMailboxFull {
+		t.Fatal("want mailbox full", err)
+	}
+
+	// 引用它的消息被 clean 以后释放额度并删除文件
+	msg := NewNormalMessage(testOwner, JID(peer), "", (&Blob{Hash: put.Hash, Size: put.Size}).Attrs()...)
+	m.maxBytes = 0
+	if err := m.putMsg(msg); err != nil {
+		t.Fatal(err)
+	}
+	m.doCleanMsg(&CleanMsg{Jid: JID(peer), Ids: []string{msg.Envelope.Id}})
+	if u := m.usage(peer); u.Bytes != 0 || u.Count != 0 {
+		t.Fatal("quota must be released", u)
+	}
+	if _, ok := m.blobs.size(put.Hash); ok {
+		t.Fatal("unreferenced blob must be deleted")
+	}
+
+	// 一直没有消息引用的按有效期清理，有引用的保留
+	orphan, kept := newTestBlobPut(JID(peer), 10), newTestBlobPut(JID(peer), 20)
+	for _, p := range []*BlobPut{orphan, kept} {
+		if err := m.reserveBlob(p); err != nil {
+			t.Fatal(err)
+		}
+		m.blobs.write("a", p.Hash, p.Size, 0, p.Data)
+	}
+	if err := m.putMsg(NewNormalMessage(testOwner, JID(peer), "", (&Blob{Hash: kept.Hash}).Attrs()...)); err != nil {
+		t.Fatal(err)
+	}
+	if n := m.sweepBlobs(time.Now()); n != 0 {
+		t.Fatal("blob must not be swept before ttl", n)
+	}
+	if n := m.sweepBlobs(time.Now().Add(2 * time.Hour)); n != 1 {
+		t.Fatal("orphan blob must be swept", n)
+	}
+	if _, ok := m.blobs.size(orphan.Hash); ok {
+		t.Fatal("orphan blob must be deleted")
+	}
+	if _, ok := m.blobs.size(kept.Hash); !ok {
+		t.Fatal("referenced blob must be kept")
+	}
+}
@@ -4,6 +4,7 @@
 package chat
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/sha1"
@@ -16,6 +17,7 @@ import (
 	"github.com/tendermint/go-amino"
 	"io"
 	"log"
+	"sync"
 )
 
 // group struct =====================
@@ -50,6 +52,19 @@ type (
 		ParentHash []byte
 	}
 
+	// 从 From 开始（空则从当前 head 开始）向前翻页，最多返回 Limit 条
+	GroupHistoryReq struct {
+		Gid   GID
+		From  []byte
+		Limit int
+	}
+
+	GroupHistoryRsp struct {
+		Head     []byte
+		Messages []*GroupMessage
+		Err      string
+	}
+
 	GroupMember struct {
 		Id     JID    `json:"id,omitempty"`
 		Name   string `json:"name,omitempty"`
@@ -70,7 +85,8 @@ type (
 		MemberId       JID
 	}
 	groupdb struct {
-		db, groupTab, memberTab ldb.Database
+		db, groupTab, memberTab, msgTab ldb.Database
+		msgLock                         sync.Mutex
 	}
 	MemberAction string
 )
@@ -80,6 +96,7 @@ const (
 	SUB  MemberAction = "-"
 	FROM MemberAction = "f"
 	TO   MemberAction = "t"
+	DROP MemberAction = "x" // 群解散，作为 memberlog 的最后一条
 )
 
 func (g *GroupRsp) FromBytes(dat []byte) (*GroupRsp, error) {
@@ -106,6 +123,10 @@ func (g *Group) FromReader(rw io.ReadWriter) (*Group, error) {
 const (
 	group_prefix  = "GROUP"
 	member_prefix = "GROUP_MEMBER"
+	msg_prefix    = "GROUP_MSG"
+
+	defHistoryLimit = 20
+	maxHistoryLimit = 100
 )
 
 var (
@@ -114,12 +135,43 @@ var (
 	memberLastK    = func(gid GID) []byte { return []byte(fmt.Sprintf("%s_member_last", gid)) }
 	memberLogK     = func(gid GID, id string) []byte { return []byte(fmt.Sprintf("%s_%s_memberlog", gid, id)) }
 	memberLastlogK = func(gid GID) []byte { return []byte(fmt.Sprintf("%s_memberlog_last", gid)) }
+	groupMsgK      = func(gid GID, h []byte) []byte { return []byte(fmt.Sprintf("%s_%x_msg", gid, h)) }
+	groupMsgLastK  = func(gid GID) []byte { return []byte(fmt.Sprintf("%s_msg_last", gid)) }
+	groupMsgIdK    = func(gid GID, id string) []byte { return []byte(fmt.Sprintf("%s_%s_msgid", gid, id)) }
 )
 
+// 链上的 hash 同时覆盖消息和 ParentHash，改动任何一条历史都会使后续的链接对不上
+func (g *GroupMessage) Hash() []byte {
+	return hash(append(g.Msg.Hash(), g.ParentHash...))
+}
+
+func (g *GroupHistoryRsp) FromBytes(dat []byte) (*GroupHistoryRsp, error) {
+	err := amino.UnmarshalBinaryLengthPrefixed(dat, g)
+	return g, err
+}
+
+// 校验 Messages 是从 from 开始向前的一段连续的链
+func (g *GroupHistoryRsp) Verify(from []byte) error {
+	if len(from) == 0 {
+		from = g.Head
+	}
+	for _, gm := range g.Messages {
+		if gm == nil || gm.Msg == nil {
+			return errors.New("bad group message")
+		}
+		if !bytes.Equal(gm.Hash(), from) {
+			return fmt.Errorf("group history broken at %x", from)
+		}
+		from = gm.ParentHash
+	}
+	return nil
+}
+
 func newGroupDB(db ldb.Database) *groupdb {
 	gdb := &groupdb{db: db}
 	gdb.groupTab = ldb.NewTable(db, group_prefix)
 	gdb.memberTab = ldb.NewTable(db, member_prefix)
+	gdb.msgTab = ldb.NewTable(db, msg_prefix)
 	return gdb
 }
 
@@ -169,6 +221,53 @@ func (g *groupdb) getGroup(id GID) (*Group, error) {
 	return g._setLastlog(group), nil
 }
 
+// 删除群和群下全部的 member / memberlog / 消息链，最后只留一条 DROP 日志
+func (g *groupdb) dropGroup(group *Group) error {
+	log.Println("dropGroup-start", "gid", group.Id, "owner", group.Owner.Id)
+	var (
+		gid       = group.Id
+		prefix    = append([]byte(member_prefix), []byte(fmt.Sprintf("%s_", gid))...)
+		msgPrefix = append([]byte(msg_prefix), []byte(fmt.Sprintf("%s_", gid))...)
+		memberLog = &MemberLog{Id: uuid.New().String(), Action: DROP, Gid: gid, MemberId: group.Owner.Id}
+	)
+	if err := g.groupTab.Delete([]byte(gid)); err != nil {
+		log.Println("dropGroup-error", "gid", gid, "err", err)
+		return err
+	}
+	if lastLog, err := g.memberTab.Get(memberLastlogK(gid)); err == nil {
+		last := new(MemberLog)
+		if err = amino.UnmarshalBinaryLengthPrefixed(lastLog, last); err == nil {
+			memberLog.Prve = last.Id
+		}
+	}
+	it := g.db.NewIterator()
+	for ok := it.Seek(prefix); ok && bytes.HasPrefix(it.Key(), prefix); ok = it.Next() {
+		g.db.Delete(it.Key())
+	}
+	it.Release()
+	g.msgLock.Lock()
+	mit := g.db.NewIterator()
+	for ok := mit.Seek(msgPrefix); ok && bytes.HasPrefix(mit.Key(), msgPrefix); ok = mit.Next() {
+		g.db.Delete(mit.Key())
+	}
+	mit.Release()
+	g.msgLock.Unlock()
+	tombstone := mustToByte(memberLog)
+	g.memberTab.Put(memberLogK(gid, memberLog.Id), tombstone)
+	log.Println("dropGroup-end", "gid", gid, "logid", memberLog.Id)
+	return g.memberTab.Put(memberLastlogK(gid), tombstone)
+}
+
+// 最后一条成员日志是 DROP 的群已经解散，不能再用同一个 gid 创建
+func (g *groupdb) isDropped(gid GID) bool {
+	buf, err := g.memberTab.Get(memberLastlogK(gid))
+	if err != nil {
+		return false
+	}
+	last := new(MemberLog)
+	return amino.UnmarshalBinaryLengthPrefixed(buf, last) == nil && last.Action == DROP
+}
+
 func (g *groupdb) queryMember(gid GID, action MemberAction, id JID) []*GroupMember {
 	var gml = make([]*GroupMember, 0)
 	fn := func(id JID) (*GroupMember, JID, error) {
@@ -193,6 +292,44 @@ func (g *groupdb) queryMember(gid GID, action MemberAction, id JID) []*GroupMemb
 	return gml
 }
 
+// 从 owner 开始沿成员链取出全部成员
+func (g *groupdb) members(gid GID) ([]*GroupMember, error) {
+	group, err := g.getGroup(gid)
+	if err != nil {
+		return nil, err
+	}
+	return g.queryMember(gid, FROM, group.Owner.Id), nil
+}
+
+// 成员链中的 id 可能带有 mailboxid，所以只比较 peerid，返回链中保存的 id
+func (g *groupdb) findMember(gid GID, peerid string) (JID, bool) {
+	ml, err := g.members(gid)
+	if err != nil {
+		return "", false
+	}
+	for _, gm := range ml {
+		if gm.Id.Peerid() == peerid || string(gm.Id) == peerid {
+			return gm.Id, true
+		}
+	}
+	return "", false
+}
+
+func (g *groupdb) isMember(gid GID, peerid string) bool {
+	_, ok := g.findMember(gid, peerid)
+	return ok
+}
+
+func (g *groupdb) lastMember(gid GID) (*MemberItem, error) {
+	buf, err := g.memberTab.Get(memberLastK(gid))
+	if err != nil {
+		return nil, err
+	}
+	m := new(MemberItem)
+	err = amino.UnmarshalBinaryLengthPrefixed(buf, m)
+	return m, err
+}
+
 func (g *groupdb) getMember(gid GID, id JID) (*MemberItem, error) {
 	buf, err := g.memberTab.Get(memberK(gid, id))
 	if err != nil {
@@ -203,6 +340,54 @@ func (g *groupdb) getMember(gid GID, id JID) (*MemberItem, error) {
 	return m, err
 }
 
+// 把群消息追加到链上，返回消息的 hash ；同一个 Envelope.Id 只追加一次，重复时返回第一次的 hash 和 false
+func (g *groupdb) appendGroupMsg(msg *Message) ([]byte, bool, error) {
+	g.msgLock.Lock()
+	defer g.msgLock.Unlock()
+	gid := GID(msg.Envelope.Gid)
+	if h, err := g.msgTab.Get(groupMsgIdK(gid, msg.Envelope.Id)); err == nil {
+		return h, false, nil
+	}
+	parent, _ := g.msgTab.Get(groupMsgLastK(gid))
+	gm := &GroupMessage{Msg: msg, ParentHash: parent}
+	h := gm.Hash()
+	if err := g.msgTab.Put(groupMsgK(gid, h), mustToByte(gm)); err != nil {
+		return nil, false, err
+	}
+	if err := g.msgTab.Put(groupMsgLastK(gid), h); err != nil {
+		return nil, false, err
+	}
+	return h, true, g.msgTab.Put(groupMsgIdK(gid, msg.Envelope.Id), h)
+}
+
+func (g *groupdb) groupMsgHead(gid GID) []byte {
+	h, _ := g.msgTab.Get(groupMsgLastK(gid))
+	return h
+}
+
+func (g *groupdb) getGroupMsg(gid GID, h []byte) (*GroupMessage, error) {
+	buf, err := g.msgTab.Get(groupMsgK(gid, h))
+	if err != nil {
+		return nil, err
+	}
+	gm := new(GroupMessage)
+	err = amino.UnmarshalBinaryLengthPrefixed(buf, gm)
+	return gm, err
+}
+
+// 从 from 开始沿 ParentHash 向前取 limit 条
+func (g *groupdb) queryGroupMsg(gid GID, from []byte, limit int) []*GroupMessage {
+	gml := make([]*GroupMessage, 0)
+	for h := from; len(h) > 0 && len(gml) < limit; {
+		gm, err := g.getGroupMsg(gid, h)
+		if err != nil {
+			break
+		}
+		gml, h = append(gml, gm), gm.ParentHash
+	}
+	return gml
+}
+
 // save or delete , append memberlog
 func (g *groupdb) handleMember(gm *GroupMember) error {
 	log.Println("handleMember-start", "gid", gm.Gid, "mid", gm.Id, "action", gm.action)
@@ -325,6 +510,9 @@ func (m *mailbox) genGroup(g *Group) (*GroupRsp, error) {
 	if to == "" {
 		return nil, errors.New("mailbox not found")
 	}
+	if g.Name == "" {
+		return nil, errors.New("group name not be nil")
+	}
 	if g.Id == "" {
 		g.Id = m.newGID()
 	}
@@ -345,6 +533,7 @@ func (m *mailbox) genGroup(g *Group) (*GroupRsp, error) {
 
 func (m *mailbox) groupService() {
 	var gdb = newGroupDB(m.db)
+	m.groupMsgService(gdb)
 	// 添加/减少 成员
 	m.p2pservice.SetHandler(PID_MAILBOX_GROUP_MEMBER, func(sessionId string, pubkey *ecdsa.PublicKey, rw io.ReadWriter) error {
 		var (
@@ -352,23 +541,53 @@ func (m *mailbox) groupService() {
 			rsp = new(GroupMemberRsp)
 		)
 		defer resp(rw, rsp)
-		_, err := amino.UnmarshalBinaryLengthPrefixedReader(rw, req, 4096)
+		_, err := amino.UnmarshalBinaryLengthPrefixedReader(rw, req, 10*MAX_PKG)
 		if err != nil {
 			rsp.Err = err.Error()
 			return err
 		}
 		rsp.Action = req.Action
-		if _, err := gdb.getGroup(req.Gid); err != nil {
+		g, err := gdb.getGroup(req.Gid)
+		if err != nil {
 			rsp.Err = "group not found"
 			return err
 		}
 		switch rsp.Action {
 		case ADD, SUB:
+			caller, _ := alibp2p.ECDSAPubEncode(pubkey)
+			if err := verifyMemberReq(g, caller, req); err != nil {
+				log.Println("PID_MAILBOX_GROUP_MEMBER-error", "session", sessionId, "gid", req.Gid, "caller", caller, "err", err)
+				rsp.Err = err.Error()
+				return err
+			}
 			for _, r := range req.Members {
-				gdb.handleMember(r)
+				r.Gid, r.action = req.Gid, req.Action
+				id, ok := gdb.findMember(r.Gid, r.Id.Peerid())
+				if r.action == ADD && ok {
+					// 重复添加会破坏成员链
+					continue
+				} else if r.action == SUB {
+					if !ok {
+						continue
+					}
+					r.Id = id
+				}
+				if err := gdb.handleMember(r); err != nil {
+					rsp.Err = err.Error()
+					return err
+				}
 			}
 			rsp.Result = SUCCESS
 		case FROM, TO: // query
+			if req.Id == "" {
+				// 没有指定起点时，FROM 从 owner 开始，TO 从最后一个成员开始
+				req.Id = g.Owner.Id
+				if req.Action == TO {
+					if last, err := gdb.lastMember(req.Gid); err == nil {
+						req.Id = last.Id
+					}
+				}
+			}
 			req.Members = gdb.queryMember(req.Gid, req.Action, req.Id)
 			result, err := amino.MarshalBinaryLengthPrefixed(req)
 			if err != nil {
@@ -398,7 +617,31 @@ func (m *mailbox) groupService() {
 		}
 
 		myid, _ := alibp2p.ECDSAPubEncode(pubkey)
-		req.Owner = &GroupMember{Id: JID(myid)}
+		if g, err := gdb.getGroup(req.Id); err == nil {
+			// 只带 Id 的请求是查询
+			if req.Name == "" && req.Comment == "" {
+				resp(rw, GroupRsp{Group: g})
+				log.Println("PID_MAILBOX_GROUP_UPDATE-end", "session", sessionId, "gid", req.Id, "query", true)
+				return nil
+			}
+			if err := verifyGroupUpdate(g, myid); err != nil {
+				resp(rw, GroupRsp{Err: err.Error()})
+				log.Println("PID_MAILBOX_GROUP_UPDATE-error-5", "session", sessionId, "gid", req.Id, "err", err)
+				return err
+			}
+			req.Owner = g.Owner
+		} else if req.Name == "" && req.Comment == "" {
+			// 查询不存在的群不会创建
+			resp(rw, GroupRsp{Err: errGroupNotFound.Error()})
+			log.Println("PID_MAILBOX_GROUP_UPDATE-error-6", "session", sessionId, "gid", req.Id, "err", errGroupNotFound)
+			return errGroupNotFound
+		} else if gdb.isDropped(req.Id) {
+			resp(rw, GroupRsp{Err: errGroupDropped.Error()})
+			log.Println("PID_MAILBOX_GROUP_UPDATE-error-7", "session", sessionId, "gid", req.Id, "err", errGroupDropped)
+			return errGroupDropped
+		} else {
+			req.Owner = &GroupMember{Id: JID(myid)}
+		}
 		err = gdb.saveGroup(req)
 		if err != nil {
 			resp(rw, GroupRsp{Err: err.Error()})
@@ -415,5 +658,327 @@ func (m *mailbox) groupService() {
 		log.Println("PID_MAILBOX_GROUP_UPDATE-end", "session", sessionId, "err", err)
 		return err
 	})
+	// 查询，只读
+	m.p2pservice.SetHandler(PID_MAILBOX_GROUP_GET, func(sessionId string, pubkey *ecdsa.PublicKey, rw io.ReadWriter) error {
+		var gid GID
+		_, err := amino.UnmarshalBinaryLengthPrefixedReader(rw, &gid, 256)
+		if err != nil {
+			resp(rw, GroupRsp{Err: err.Error()})
+			log.Println("PID_MAILBOX_GROUP_GET-error-1", "session", sessionId, "err", err)
+			return err
+		}
+		g, err := gdb.getGroup(gid)
+		if err != nil {
+			resp(rw, GroupRsp{Err: errGroupNotFound.Error()})
+			return errGroupNotFound
+		}
+		return resp(rw, GroupRsp{Group: g})
+	})
+	// 解散
+	m.p2pservice.SetHandler(PID_MAILBOX_GROUP_DROP, func(sessionId string, pubkey *ecdsa.PublicKey, rw io.ReadWriter) error {
+		log.Println("PID_MAILBOX_GROUP_DROP-start", "session", sessionId)
+		var gid GID
+		_, err := amino.UnmarshalBinaryLengthPrefixedReader(rw, &gid, 256)
+		if err != nil {
+			resp(rw, GroupRsp{Err: err.Error()})
+			log.Println("PID_MAILBOX_GROUP_DROP-error-1", "session", sessionId, "err", err)
+			return err
+		}
+		g, err := gdb.getGroup(gid)
+		if err != nil {
+			resp(rw, GroupRsp{Err: "group not found"})
+			log.Println("PID_MAILBOX_GROUP_DROP-error-2", "session", sessionId, "gid", gid, "err", err)
+			return err
+		}
+		myid, _ := alibp2p.ECDSAPubEncode(pubkey)
+		if g.Owner == nil || g.Owner.Id.Peerid() != myid {
+			err = errPermissionDenied
+			resp(rw, GroupRsp{Err: err.Error()})
+			log.Println("PID_MAILBOX_GROUP_DROP-error-3", "session", sessionId, "gid", gid, "err", err)
+			return err
+		}
+		if err = gdb.dropGroup(g); err != nil {
+			resp(rw, GroupRsp{Err: err.Error()})
+			log.Println("PID_MAILBOX_GROUP_DROP-error-4", "session", sessionId, "gid", gid, "err", err)
+			return err
+		}
+		resp(rw, GroupRsp{Group: g})
+		log.Println("PID_MAILBOX_GROUP_DROP-end", "session", sessionId, "gid", gid)
+		return nil
+	})
+
+}
+
+var (
+	errPermissionDenied = errors.New("permission denied")
+	errGroupNotFound    = errors.New("group not found")
+	errGroupDropped     = errors.New("group dropped")
+	errOwnerCanNotLeave = errors.New("owner can not be removed")
+)
+
+// 能管理成员的人，目前只有 owner，以后的 admin 也在这里放行
+func isGroupAdmin(g *Group, peerid string) bool {
+	return g.Owner != nil && g.Owner.Id.Peerid() == peerid
+}
+
+// 只有 owner 可以修改群信息
+func verifyGroupUpdate(g *Group, caller string) error {
+	if caller == "" || !isGroupAdmin(g, caller) {
+		return errPermissionDenied
+	}
+	return nil
+}
+
+// owner 可以添加和删除成员，普通成员只能删除自己（退群），owner 不能被删除
+func verifyMemberReq(g *Group, caller string, req *GroupMemberReq) error {
+	if caller == "" {
+		return errPermissionDenied
+	}
+	if req.Action == SUB {
+		for _, r := range req.Members {
+			if g.Owner != nil && r.Id.Peerid() == g.Owner.Id.Peerid() {
+				return errOwnerCanNotLeave
+			}
+		}
+	}
+	if isGroupAdmin(g, caller) {
+		return nil
+	}
+	if req.Action == SUB && len(req.Members) == 1 && req.Members[0].Id.Peerid() == caller {
+		return nil
+	}
+	return errPermissionDenied
+}
+
+// 返回的错误码用于 writeRsp
+func (m *mailbox) verifyGroupMsg(gdb *groupdb, pubkey *ecdsa.PublicKey, msg *Message) (int, error) {
+	if msg.Envelope.Type != GroupMsg {
+		return RSP_BAD_REQUEST, errors.New("not group message")
+	}
+	gid := GID(msg.Envelope.Gid)
+	if gid == "" {
+		return RSP_BAD_REQUEST, errors.New("gid not be nil")
+	}
+	from, err := alibp2p.ECDSAPubEncode(pubkey)
+	if err != nil {
+		return RSP_UNAUTHORIZED, err
+	}
+	if msg.Envelope.From.Peerid() != from && string(msg.Envelope.From) != from {
+		return RSP_FORBIDDEN, errors.New("sender not match")
+	}
+	if err := msg.Verify(); err != nil {
+		return RSP_UNAUTHORIZED, err
+	}
+	if _, err := gdb.getGroup(gid); err != nil {
+		return RSP_BAD_REQUEST, errGroupNotFound
+	}
+	if !gdb.isMember(gid, from) {
+		return RSP_FORBIDDEN, errors.New("sender not member")
+	}
+	return RSP_OK, nil
+}
+
+// 把群消息投递给除发送者以外的每个成员，不在线的成员存入成员自己的 mailbox
+func (m *mailbox) fanoutGroupMsg(gdb *groupdb, msg *Message) {
+	ml, err := gdb.members(GID(msg.Envelope.Gid))
+	if err != nil {
+		log.Println("fanoutGroupMsg-error", "gid", msg.Envelope.Gid, "err", err)
+		return
+	}
+	from := msg.Envelope.From.Peerid()
+	if from == "" {
+		from = string(msg.Envelope.From)
+	}
+	for _, gm := range ml {
+		to := gm.Id.Peerid()
+		if to == "" {
+			to = string(gm.Id)
+		}
+		if to == from {
+			continue
+		}
+		cpy := *msg
+		cpy.Envelope.To = gm.Id
+		go func(to string, msg *Message) {
+			if rtn, err := m.chunks.request(to, PID_NORMAL, msg.Bytes()); err == nil && readRsp(rtn) == nil {
+				return
+			}
+			// 投递到成员的每一个 mailbox ，mailbox 是本节点时直接存在本地；
+			// 成员不会来本节点取消息时不保存，避免占用对方用不到的额度
+			var saved bool
+			for _, mailid := range msg.Envelope.To.Mailids() {
+				if mailid == m.myid.Peerid() {
+					if err := m.putMsg(msg); err != nil {
+						log.Println("fanoutGroupMsg-putMsg-error", "gid", msg.Envelope.Gid, "to", to, "err", err)
+						continue
+					}
+					saved = true
+				} else if rtn, err := m.chunks.request(mailid, PID_MAILBOX, msg.Bytes()); err == nil && readRsp(rtn) == nil {
+					saved = true
+				}
+			}
+			if !saved {
+				log.Println("fanoutGroupMsg-drop", "gid", msg.Envelope.Gid, "id", msg.Envelope.Id, "to", to, "err", "member unreachable")
+			}
+		}(to, &cpy)
+	}
+}
+
+func (m *mailbox) groupMsgService(gdb *groupdb) {
+	// 群消息，校验发送者是群成员后分发
+	m.chunks.SetHandler(PID_MAILBOX_GROUP_MSG, func(sessionId string, pubkey *ecdsa.PublicKey, rw io.ReadWriter) error {
+		msg, err := new(Message).FromReader(rw)
+		if err != nil {
+			writeRsp(rw, RSP_BAD_REQUEST, err)
+			return err
+		}
+		message := msg.(*Message)
+		if code, err := m.verifyGroupMsg(gdb, pubkey, message); err != nil {
+			log.Println("PID_MAILBOX_GROUP_MSG-error", "session", sessionId, "gid", message.Envelope.Gid, "err", err)
+			writeRsp(rw, code, err)
+			return err
+		}
+		_, added, err := gdb.appendGroupMsg(message)
+		if err != nil {
+			log.Println("PID_MAILBOX_GROUP_MSG-error", "session", sessionId, "gid", message.Envelope.Gid, "err", err)
+			writeRsp(rw, RSP_INTERNAL, err)
+			return err
+		}
+		// 发送队列重试时同一条消息可能到达多次，只分发第一次
+		if added {
+			go m.fanoutGroupMsg(gdb, message)
+		}
+		return writeRsp(rw, RSP_OK, nil)
+	})
+	// 群消息历史，只有群成员可以查询
+	m.p2pservice.SetHandler(PID_MAILBOX_GROUP_HISTORY, func(sessionId string, pubkey *ecdsa.PublicKey, rw io.ReadWriter) error {
+		var (
+			req = new(GroupHistoryReq)
+			rsp = new(GroupHistoryRsp)
+		)
+		defer resp(rw, rsp)
+		_, err := amino.UnmarshalBinaryLengthPrefixedReader(rw, req, 4096)
+		if err != nil {
+			rsp.Err = err.Error()
+			return err
+		}
+		from, err := alibp2p.ECDSAPubEncode(pubkey)
+		if err != nil {
+			rsp.Err = err.Error()
+			return err
+		}
+		if !gdb.isMember(req.Gid, from) {
+			rsp.Err = "not member"
+			return errors.New(rsp.Err)
+		}
+		if req.Limit <= 0 {
+			req.Limit = defHistoryLimit
+		} else if req.Limit > maxHistoryLimit {
+			req.Limit = maxHistoryLimit
+		}
+		rsp.Head = gdb.groupMsgHead(req.Gid)
+		if len(req.From) == 0 {
+			req.From = rsp.Head
+		}
+		rsp.Messages = gdb.queryGroupMsg(req.Gid, req.From, req.Limit)
+		return nil
+	})
+}
+
+// 获取群信息，群不存在时返回 group not found
+func (m *mailbox) getGroup(gid GID) (*GroupRsp, error) {
+	pkg, err := toByte(gid)
+	if err != nil {
+		return nil, err
+	}
+	rtn, err := m.p2pservice.RequestWithTimeout(JID(gid).Mailid(), PID_MAILBOX_GROUP_GET, pkg, timeout)
+	if err != nil {
+		return nil, err
+	}
+	grsp, err := new(GroupRsp).FromBytes(rtn)
+	if err != nil {
+		return nil, err
+	}
+	if grsp.Err != "" {
+		return nil, errors.New(grsp.Err)
+	}
+	return grsp, nil
+}
 
+func (m *mailbox) memberReq(req *GroupMemberReq) (*GroupMemberRsp, error) {
+	pkg, err := toByte(req)
+	if err != nil {
+		return nil, err
+	}
+	rtn, err := m.p2pservice.RequestWithTimeout(JID(req.Gid).Mailid(), PID_MAILBOX_GROUP_MEMBER, pkg, timeout)
+	if err != nil {
+		return nil, err
+	}
+	rsp := new(GroupMemberRsp)
+	if err = amino.UnmarshalBinaryLengthPrefixed(rtn, rsp); err != nil {
+		return nil, err
+	}
+	if rsp.Err != "" {
+		return nil, errors.New(rsp.Err)
+	}
+	return rsp, nil
+}
+
+// 添加或删除成员，action 为 ADD 或 SUB
+func (m *mailbox) updateMembers(gid GID, action MemberAction, members []*GroupMember) error {
+	_, err := m.memberReq(&GroupMemberReq{Gid: gid, Action: action, Members: members})
+	return err
+}
+
+// 从 from 开始按 action (FROM 向后 / TO 向前) 列出成员，from 为空时从链的一端开始
+func (m *mailbox) listMembers(gid GID, from JID, action MemberAction) ([]*GroupMember, error) {
+	rsp, err := m.memberReq(&GroupMemberReq{Gid: gid, Id: from, Action: action})
+	if err != nil {
+		return nil, err
+	}
+	ret := new(GroupMemberReq)
+	if err = amino.UnmarshalBinaryLengthPrefixed(rsp.Result, ret); err != nil {
+		return nil, err
+	}
+	return ret.Members, nil
+}
+
+// 解散群，只有 owner 可以操作
+func (m *mailbox) dropGroup(gid GID) (*GroupRsp, error) {
+	pkg, err := toByte(gid)
+	if err != nil {
+		return nil, err
+	}
+	rtn, err := m.p2pservice.RequestWithTimeout(JID(gid).Mailid(), PID_MAILBOX_GROUP_DROP, pkg, timeout)
+	if err != nil {
+		return nil, err
+	}
+	grsp, err := new(GroupRsp).FromBytes(rtn)
+	if err != nil {
+		return nil, err
+	}
+	if grsp.Err != "" {
+		return nil, errors.New(grsp.Err)
+	}
+	return grsp, nil
+}
+
+// 查询群消息历史，并校验返回的链
+func (m *mailbox) groupHistory(gid GID, from []byte, limit int) (*GroupHistoryRsp, error) {
+	pkg, err := toByte(&GroupHistoryReq{Gid: gid, From: from, Limit: limit})
+	if err != nil {
+		return nil, err
+	}
+	rtn, err := m.p2pservice.RequestWithTimeout(JID(gid).Mailid(), PID_MAILBOX_GROUP_HISTORY, pkg, timeout)
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := new(GroupHistoryRsp).FromBytes(rtn)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.Err != "" {
+		return nil, errors.New(rsp.Err)
+	}
+	return rsp, rsp.Verify(from)
 }
@@ -0,0 +1,211 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"bytes"
+	"errors"
+	"github.com/cc14514/go-achat-node/ldb"
+	"github.com/tendermint/go-amino"
+	"testing"
+)
+
+const (
+	testOwner   = JID("16Uiu2HAkzRux7XYhYfmTDY2C7xuBapitNp25DvKvpvVnCf9bRne7")
+	testMember1 = JID("16Uiu2HAmN2eZ9DLJhccS1R49Qc1tpdGMdbC8uWwzUCUAfRpRvEvd16Uiu2HAm91Fc9psqiTTiEpDEPqxc8cLqj4fhjUqPK6LwGZvLKx3j")
+	testMember2 = JID("16Uiu2HAkvsWx5Byt8RCXs2ScrmPCZteHjcdQhzxdHCVYTjtYxPYr")
+	testGid     = GID("16Uiu2HAmU1TyDqb9BSBDSHVhbGgzJy2bLxLFnRDc5C8aUNtDkf2K16Uiu2HAm2jxd1dv26b62H1qi2HsiHkzvkynM5nwAoYHccMyxFdG9")
+)
+
+func newTestGroupDB(t *testing.T) *groupdb {
+	db, err := ldb.NewLDBDatabase(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	gdb := newGroupDB(db)
+	if err := gdb.saveGroup(&Group{Id: testGid, Owner: &GroupMember{Id: testOwner}, Name: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	return gdb
+}
+
+func TestGroupMembers(t *testing.T) {
+	gdb := newTestGroupDB(t)
+	for _, id := range []JID{testMember1, testMember2} {
+		if err := gdb.handleMember(&GroupMember{Id: id, Gid: testGid, action: ADD}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ml, err := gdb.members(testGid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ml) != 3 || ml[0].Id != testOwner || ml[1].Id != testMember1 || ml[2].Id != testMember2 {
+		t.Fatal("bad member chain", ml)
+	}
+	if !gdb.isMember(testGid, testMember1.Peerid()) {
+		t.Fatal("member1 must be member")
+	}
+	if id, ok := gdb.findMember(testGid, testMember1.Peerid()); !ok || id != testMember1 {
+		t.Fatal("findMember must return the stored jid", id)
+	}
+	last, err := gdb.lastMember(testGid)
+	if err != nil || last.Id != testMember2 {
+		t.Fatal("bad last member", last, err)
+	}
+	if rl := gdb.queryMember(testGid, TO, last.Id); len(rl) != 3 || rl[2].Id != testOwner {
+		t.Fatal("bad reverse chain", rl)
+	}
+
+	if err := gdb.handleMember(&GroupMember{Id: testMember1, Gid: testGid, action: SUB}); err != nil {
+		t.Fatal(err)
+	}
+	if gdb.isMember(testGid, testMember1.Peerid()) {
+		t.Fatal("member1 must not be member")
+	}
+	if !gdb.isMember(testGid, testOwner.Peerid()) || !gdb.isMember(testGid, testMember2.Peerid()) {
+		t.Fatal("owner and member2 must be member")
+	}
+}
+
+func TestGroupMsgChain(t *testing.T) {
+	gdb := newTestGroupDB(t)
+	var last *Message
+	for _, c := range []string{"a", "b", "c"} {
+		last = NewGroupMessage(testOwner, testGid, c)
+		if _, added, err := gdb.appendGroupMsg(last); err != nil || !added {
+			t.Fatal(added, err)
+		}
+	}
+	head := gdb.groupMsgHead(testGid)
+	// 重试发来的同一条消息不再追加
+	if h, added, err := gdb.appendGroupMsg(last); err != nil || added || !bytes.Equal(h, head) {
+		t.Fatal("duplicate message must not be appended", added, err)
+	}
+	if !bytes.Equal(gdb.groupMsgHead(testGid), head) {
+		t.Fatal("head must not change")
+	}
+	rsp := &GroupHistoryRsp{Head: head, Messages: gdb.queryGroupMsg(testGid, head, 2)}
+	if len(rsp.Messages) != 2 || rsp.Messages[0].Msg.Payload.Content != "c" || rsp.Messages[1].Msg.Payload.Content != "b" {
+		t.Fatal("bad page", rsp.Messages)
+	}
+	if err := rsp.Verify(nil); err != nil {
+		t.Fatal(err)
+	}
+	next := rsp.Messages[1].ParentHash
+	page := &GroupHistoryRsp{Head: head, Messages: gdb.queryGroupMsg(testGid, next, 2)}
+	if len(page.Messages) != 1 || len(page.Messages[0].ParentHash) != 0 {
+		t.Fatal("bad last page", page.Messages)
+	}
+	if err := page.Verify(next); err != nil {
+		t.Fatal(err)
+	}
+
+	rsp.Messages[1].Msg.Payload.Content = "x"
+	if err := rsp.Verify(nil); err == nil {
+		t.Fatal("tampered history must not verify")
+	}
+}
+
+func TestDropGroup(t *testing.T) {
+	gdb := newTestGroupDB(t)
+	if err := gdb.handleMember(&GroupMember{Id: testMember1, Gid: testGid, action: ADD}); err != nil {
+		t.Fatal(err)
+	}
+	h, _, err := gdb.appendGroupMsg(NewGroupMessage(testOwner, testGid, "hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := gdb.getGroup(testGid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gdb.isDropped(testGid) {
+		t.Fatal("group not dropped yet")
+	}
+	if err := gdb.dropGroup(g); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gdb.getGroup(testGid); err == nil {
+		t.Fatal("group must be dropped")
+	}
+	if _, err := gdb.getMember(testGid, testOwner); err == nil {
+		t.Fatal("owner must be purged")
+	}
+	if _, err := gdb.getMember(testGid, testMember1); err == nil {
+		t.Fatal("member must be purged")
+	}
+	if _, err := gdb.getGroupMsg(testGid, h); err == nil || len(gdb.groupMsgHead(testGid)) != 0 {
+		t.Fatal("group messages must be purged")
+	}
+	buf, err := gdb.memberTab.Get(memberLastlogK(testGid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := new(MemberLog)
+	if err := amino.UnmarshalBinaryLengthPrefixed(buf, last); err != nil {
+		t.Fatal(err)
+	}
+	if last.Action != DROP || last.Prve == "" {
+		t.Fatal("bad tombstone", last)
+	}
+	if !gdb.isDropped(testGid) {
+		t.Fatal("dropped group must not be re-created")
+	}
+	if _, err := gdb.memberTab.Get(memberLogK(testGid, last.Prve)); err == nil {
+		t.Fatal("memberlog must be purged")
+	}
+}
+
+func TestVerifyMemberReq(t *testing.T) {
+	g := &Group{Id: testGid, Owner: &GroupMember{Id: testOwner}}
+	member := func(id JID) []*GroupMember { return []*GroupMember{{Id: id}} }
+	for i, c := range []struct {
+		caller string
+		req    *GroupMemberReq
+		err    error
+	}{
+		{testOwner.Peerid(), &GroupMemberReq{Action: ADD, Members: member(testMember1)}, nil},
+		{testOwner.Peerid(), &GroupMemberReq{Action: SUB, Members: member(testMember1)}, nil},
+		{testOwner.Peerid(), &GroupMemberReq{Action: SUB, Members: member(testOwner)}, errOwnerCanNotLeave},
+		{testMember1.Peerid(), &GroupMemberReq{Action: SUB, Members: member(testMember1)}, nil},
+		{testMember1.Peerid(), &GroupMemberReq{Action: SUB, Members: member(testMember2)}, errPermissionDenied},
+		{testMember1.Peerid(), &GroupMemberReq{Action: ADD, Members: member(testMember2)}, errPermissionDenied},
+		{testMember1.Peerid(), &GroupMemberReq{Action: SUB, Members: append(member(testMember1), member(testMember2)...)}, errPermissionDenied},
+		{"", &GroupMemberReq{Action: ADD, Members: member(testMember2)}, errPermissionDenied},
+	} {
+		if err := verifyMemberReq(g, c.caller, c.req); err != c.err {
+			t.Fatal(i, "want", c.err, "got", err)
+		}
+	}
+	if verifyGroupUpdate(g, testOwner.Peerid()) != nil || verifyGroupUpdate(g, testMember1.Peerid()) != errPermissionDenied || verifyGroupUpdate(g, "") != errPermissionDenied {
+		t.Fatal("only owner can update group")
+	}
+}
+
+// 非成员发的群消息被明确拒绝，不进入发送队列
+func TestRejectedGroupMsgNotQueued(t *testing.T) {
+	var (
+		gdb     = newTestGroupDB(t)
+		key, id = newTestKey(t)
+		msg     = NewGroupMessage(JID(id), testGid, "hello")
+		buf     = new(bytes.Buffer)
+	)
+	if err := msg.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	code, err := new(mailbox).verifyGroupMsg(gdb, &key.PublicKey, msg)
+	if err == nil || code != RSP_FORBIDDEN {
+		t.Fatal("non member must be rejected", code, err)
+	}
+	writeRsp(buf, code, err)
+	err = readRsp(buf.Bytes())
+	if !errors.Is(err, errPermissionDenied) || errors.Is(err, errBadSignature) {
+		t.Fatal("want forbidden", err)
+	}
+	if queueable(msg, err) {
+		t.Fatal("rejected group message must not be queued", err)
+	}
+}
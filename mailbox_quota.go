@@ -0,0 +1,137 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"errors"
+	"github.com/tendermint/go-amino"
+	"sync"
+	"time"
+)
+
+/*
+mailbox 的限额：
+每个接收人的离线消息条数和字节数，记录在 "QUOTA" + peerid 中，在 putMsg 和删除消息时更新；
+每个发送人（连接的 peerid ，不是 Envelope.From ，避免重放别人的消息消耗别人的额度）的写入速率，令牌桶，只在内存中
+*/
+
+const quota_prefix = "QUOTA"
+
+var (
+	ErrMailboxFull = errors.New("mailbox full")
+	ErrRateLimited = errors.New("rate limited")
+
+	defMailboxMaxCount int64 = 10000
+	defMailboxMaxBytes int64 = 64 * 1024 * 1024
+	defSenderRate            = 10.0 // 每秒
+	defSenderBurst           = 100
+	maxBuckets               = 10000
+)
+
+type (
+	// 接收人已经使用的额度
+	mailboxUsage struct {
+		Count int64
+		Bytes int64
+	}
+
+	bucket struct {
+		tokens float64
+		last   time.Time
+	}
+
+	limiter struct {
+		lock    sync.Mutex
+		rate    float64
+		burst   float64
+		buckets map[string]*bucket
+	}
+)
+
+func newLimiter(rate float64, burst int) *limiter {
+	return &limiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+func (l *limiter) allow(key string, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.rate <= 0 {
+		return true
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		// 已经回满的桶和新建的一样，可以删掉
+		if len(l.buckets) >= maxBuckets {
+			for k, b := range l.buckets {
+				if now.Sub(b.last).Seconds()*l.rate >= l.burst {
+					delete(l.buckets, k)
+				}
+			}
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func quotaK(peerid string) []byte {
+	return []byte(quota_prefix + peerid)
+}
+
+func (m *mailbox) usage(peerid string) *mailboxUsage {
+	u := new(mailboxUsage)
+	if buf, err := m.db.Get(quotaK(peerid)); err == nil {
+		amino.UnmarshalBinaryLengthPrefixed(buf, u)
+	}
+	return u
+}
+
+// delta 为增加的条数和字节数，调用时需要持有 m.lock
+func (m *mailbox) addUsage(peerid string, count, size int64) error {
+	u := m.usage(peerid)
+	u.Count, u.Bytes = u.Count+count, u.Bytes+size
+	if u.Count < 0 {
+		u.Count = 0
+	}
+	if u.Bytes < 0 {
+		u.Bytes = 0
+	}
+	return m.db.Put(quotaK(peerid), mustToByte(u))
+}
+
+// 新增 count 条、size 字节以后是否超出限额，限额小于等于 0 表示不限制
+func (m *mailbox) overQuota(peerid string, count, size int64) bool {
+	u := m.usage(peerid)
+	return (m.maxCount > 0 && u.Count+count > m.maxCount) || (m.maxBytes > 0 && u.Bytes+size > m.maxBytes)
+}
+
+// 连接的 peerid 超过写入速率时返回 ErrRateLimited
+func (m *mailbox) allowSender(peerid string) error {
+	if m.limiter != nil && !m.limiter.allow(peerid, time.Now()) {
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// 把旧版本 mailbox 返回的错误字符串还原成 ErrMailboxFull / ErrRateLimited ，方便调用方区分
+func mailboxError(rtn []byte) error {
+	switch string(rtn) {
+	case string(SUCCESS):
+		return nil
+	case ErrMailboxFull.Error():
+		return ErrMailboxFull
+	case ErrRateLimited.Error():
+		return ErrRateLimited
+	}
+	return errors.New(string(rtn))
+}
@@ -0,0 +1,74 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMailboxQuota(t *testing.T) {
+	m := newTestMailbox(t)
+	m.ttl, m.maxCount = time.Hour, 2
+	var (
+		m1 = NewNormalMessage(testMember2, testOwner, "1")
+		m2 = NewNormalMessage(testMember2, testOwner, "2")
+		m3 = NewNormalMessage(testMember2, testOwner, "3")
+	)
+	for _, msg := range []*Message{m1, m2, m1} {
+		if err := m.putMsg(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.putMsg(m3); err != ErrMailboxFull {
+		t.Fatal("want mailbox full", err)
+	}
+	// 其他接收人不受影响
+	if err := m.putMsg(NewNormalMessage(testMember2, testMember1, "x")); err != nil {
+		t.Fatal(err)
+	}
+	m.doCleanMsg(&CleanMsg{Jid: testOwner, Ids: []string{m1.Envelope.Id, "not-exist"}})
+	if u := m.usage(testOwner.Peerid()); u.Count != 1 || u.Bytes != int64(len(m2.Bytes())) {
+		t.Fatal("bad usage", u)
+	}
+	if err := m.putMsg(m3); err != nil {
+		t.Fatal(err)
+	}
+	m.sweep(time.Now().Add(2 * time.Hour))
+	if u := m.usage(testOwner.Peerid()); u.Count != 0 || u.Bytes != 0 {
+		t.Fatal("expired messages must release quota", u)
+	}
+
+	m.maxCount, m.maxBytes = 0, int64(len(m1.Bytes()))
+	if err := m.putMsg(m1); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.putMsg(m2); err != ErrMailboxFull {
+		t.Fatal("want mailbox full by bytes", err)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	var (
+		l   = newLimiter(1, 2)
+		now = time.Now()
+	)
+	if !l.allow("a", now) || !l.allow("a", now) || l.allow("a", now) {
+		t.Fatal("burst must be 2")
+	}
+	if !l.allow("b", now) {
+		t.Fatal("limit is per sender")
+	}
+	if !l.allow("a", now.Add(time.Second)) || l.allow("a", now.Add(time.Second)) {
+		t.Fatal("refill 1 per second")
+	}
+	// 按连接的 peerid 限速，与消息的 from 无关
+	m := &mailbox{limiter: newLimiter(1, 1)}
+	if m.allowSender("a") != nil || m.allowSender("a") != ErrRateLimited || m.allowSender("b") != nil {
+		t.Fatal("bad sender limit")
+	}
+	if mailboxError([]byte(ErrMailboxFull.Error())) != ErrMailboxFull || mailboxError(SUCCESS) != nil {
+		t.Fatal("bad mailbox error")
+	}
+}
@@ -0,0 +1,80 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"github.com/cc14514/go-achat-node/ldb"
+	"strings"
+	"testing"
+)
+
+func TestQueryPage(t *testing.T) {
+	m := newTestMailbox(t)
+	for i, content := range []string{"a", "b", "c", "d", "e"} {
+		msg := NewNormalMessage(testMember2, testOwner, content)
+		msg.Envelope.Ct = int64(100 + i/2)
+		if err := m.putMsg(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var (
+		q   = &MailboxQuery{Jid: testOwner, Limit: 2}
+		all = make(MessageList, 0)
+	)
+	for n := 0; ; n++ {
+		page := m.doQueryPage(q)
+		all = append(all, page.Messages...)
+		if !page.More {
+			break
+		}
+		if n > 5 || len(page.Messages) != 2 {
+			t.Fatal("bad page", page.Messages)
+		}
+		last := page.Messages[len(page.Messages)-1]
+		q = &MailboxQuery{Jid: testOwner, Ct: last.Envelope.Ct, Id: last.Envelope.Id, Limit: 2}
+	}
+	if len(all) != 5 {
+		t.Fatal("bad query", len(all))
+	}
+	for i := 1; i < len(all); i++ {
+		if !all.Less(i-1, i) {
+			t.Fatal("bad order", i)
+		}
+	}
+
+	// clean 以后索引也要删除
+	m.delMsg(testOwner.Peerid(), all[0].Envelope.Id)
+	if page := m.doQueryPage(&MailboxQuery{Jid: testOwner}); len(page.Messages) != 4 || page.Messages[0].Envelope.Id != all[1].Envelope.Id {
+		t.Fatal("bad page after clean", page.Messages)
+	}
+
+	// 字节数超过限制时截断，但至少返回一条
+	big := NewNormalMessage(testMember2, testMember1, strings.Repeat("x", maxQueryPageBytes))
+	if err := m.putMsg(big); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.putMsg(NewNormalMessage(testMember2, testMember1, "y")); err != nil {
+		t.Fatal(err)
+	}
+	page := m.doQueryPage(&MailboxQuery{Jid: testMember1})
+	if len(page.Messages) != 1 || !page.More {
+		t.Fatal("bad big page", len(page.Messages), page.More)
+	}
+}
+
+func TestIndexMsgCt(t *testing.T) {
+	m := newTestMailbox(t)
+	// 旧版本只保存了消息
+	old := NewNormalMessage(testMember2, testOwner, "old")
+	if err := ldb.NewTable(m.db, testOwner.Peerid()).Put([]byte(old.Envelope.Id), old.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if page := m.doQueryPage(&MailboxQuery{Jid: testOwner}); len(page.Messages) != 0 {
+		t.Fatal("no index yet", page.Messages)
+	}
+	m.indexMsgCt()
+	if page := m.doQueryPage(&MailboxQuery{Jid: testOwner}); len(page.Messages) != 1 || page.Messages[0].Envelope.Id != old.Envelope.Id {
+		t.Fatal("old message must be indexed", page.Messages)
+	}
+}
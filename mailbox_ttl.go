@@ -0,0 +1,137 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"strconv"
+	"time"
+)
+
+/*
+离线消息的有效期：mailbox 保存消息时在 EXPIRE 索引中记录过期时间，
+key = "EXPIRE" + 过期时间(8 字节大端) + peerid + msgid ，
+后台定时从最早的过期时间开始清理；发送人可以通过 ttl 属性（秒）缩短有效期，但不能超过 mailbox 的设置；
+打开 notifyExpired 时，过期的 NormalMsg 会给发送人回一条 SysMsg
+*/
+
+const (
+	expire_prefix = "EXPIRE"
+
+	MAILBOX_TTL_ATTR = "ttl"
+	MAILBOX_EXPIRED  = "expired" // SysMsg 的 event ，msgid 为过期的消息，to 为接收人
+	MAILBOX_TO_ATTR  = "to"
+)
+
+var (
+	defMailboxTTL = 7 * 24 * time.Hour
+	sweepInterval = 10 * time.Minute
+)
+
+func expireK(at int64, peerid, msgid string) []byte {
+	k := binary.BigEndian.AppendUint64([]byte(expire_prefix), uint64(at))
+	return append(append(k, []byte(peerid)...), []byte(msgid)...)
+}
+
+// 消息的有效期，取 ttl 属性和 mailbox 设置中较小的
+func (m *mailbox) msgTTL(msg *Message) time.Duration {
+	ttl := m.ttl
+	if s, ok := msg.Payload.GetAttr(MAILBOX_TTL_ATTR); ok {
+		if sec, err := strconv.ParseInt(s, 10, 64); err == nil && sec > 0 && time.Duration(sec)*time.Second < ttl {
+			ttl = time.Duration(sec) * time.Second
+		}
+	}
+	return ttl
+}
+
+func (m *mailbox) putExpire(msg *Message, now time.Time) error {
+	at := now.Add(m.msgTTL(msg)).Unix()
+	return m.db.Put(expireK(at, msg.Envelope.To.Peerid(), msg.Envelope.Id), nil)
+}
+
+// 删除 now 之前过期的消息，返回删除的消息；已经被 clean 的只删除索引
+func (m *mailbox) sweep(now time.Time) []*Message {
+	var (
+		prefix  = []byte(expire_prefix)
+		keys    = make([][]byte, 0)
+		expired = make([]*Message, 0)
+		it      = m.db.NewIterator()
+	)
+	for ok := it.Seek(prefix); ok && bytes.HasPrefix(it.Key(), prefix); ok = it.Next() {
+		k := it.Key()
+		if len(k) < len(prefix)+8+53 {
+			continue
+		}
+		if int64(binary.BigEndian.Uint64(k[len(prefix):])) > now.Unix() {
+			break
+		}
+		keys = append(keys, append([]byte{}, k...))
+	}
+	it.Release()
+	for _, k := range keys {
+		var (
+			peerid = string(k[len(prefix)+8 : len(prefix)+8+53])
+			msgid  = string(k[len(prefix)+8+53:])
+		)
+		if buf := m.delMsg(peerid, msgid); buf != nil {
+			if msg, err := new(Message).FromBytes(buf); err == nil {
+				expired = append(expired, msg.(*Message))
+			}
+		}
+		m.db.Delete(k)
+	}
+	return expired
+}
+
+// 通知发送人消息过期未送达，只尝试直连，发送人的 mailbox 是自己时存在本地
+func (m *mailbox) notifyExpired(msg *Message) {
+	if msg.Envelope.Type != NormalMsg {
+		return
+	}
+	from := msg.Envelope.From
+	notice := newMessage(m.myid, from, "", "", SysMsg,
+		Attr{Key: SYNC_EVENT_ATTR, Val: MAILBOX_EXPIRED},
+		Attr{Key: SYNC_MSGID_ATTR, Val: msg.Envelope.Id},
+		Attr{Key: MAILBOX_TO_ATTR, Val: string(msg.Envelope.To)})
+	if err := notice.Sign(m.p2pservice.Nodekey()); err != nil {
+		log.Println("notifyExpired error", "err", err)
+		return
+	}
+	if rtn, err := m.chunks.request(from.Peerid(), PID_NORMAL, notice.Bytes()); err == nil && readRsp(rtn) == nil {
+		return
+	}
+	if from.HasMailid(m.myid.Peerid()) {
+		if err := m.putMsg(notice); err != nil {
+			log.Println("notifyExpired putMsg error", "id", msg.Envelope.Id, "from", from, "err", err)
+		}
+	}
+}
+
+func (m *mailbox) sweepLoop() {
+	timer := time.NewTicker(sweepInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-m.stop:
+			return
+		case now := <-timer.C:
+			expired := m.sweep(now)
+			if len(expired) > 0 {
+				log.Println("mailbox sweep", "expired", len(expired))
+			}
+			if n := m.sweepBlobs(now); n > 0 {
+				log.Println("mailbox sweep", "blobs", n)
+			}
+			if m.notify {
+				for _, msg := range expired {
+					m.notifyExpired(msg)
+				}
+			}
+		}
+	}
+}
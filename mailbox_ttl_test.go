@@ -0,0 +1,82 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestMailboxSweep(t *testing.T) {
+	m := newTestMailbox(t)
+	m.ttl = time.Hour
+	var (
+		keep    = NewNormalMessage(testMember2, testOwner, "keep")
+		expire  = NewNormalMessage(testMember2, testOwner, "expire", Attr{Key: MAILBOX_TTL_ATTR, Val: "60"})
+		cleaned = NewNormalMessage(testMember2, testOwner, "cleaned", Attr{Key: MAILBOX_TTL_ATTR, Val: "60"})
+		long    = NewNormalMessage(testMember2, testOwner, "long", Attr{Key: MAILBOX_TTL_ATTR, Val: "86400"})
+	)
+	for _, msg := range []*Message{keep, expire, cleaned, long} {
+		if err := m.putMsg(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.doCleanMsg(&CleanMsg{Jid: testOwner, Ids: []string{cleaned.Envelope.Id}})
+
+	now := time.Now()
+	if ml := m.sweep(now); len(ml) != 0 {
+		t.Fatal("nothing expired yet", ml)
+	}
+	ml := m.sweep(now.Add(2 * time.Minute))
+	if len(ml) != 1 || ml[0].Envelope.Id != expire.Envelope.Id {
+		t.Fatal("bad expired", ml)
+	}
+	// ttl 属性不能超过 mailbox 的设置
+	if ml = m.sweep(now.Add(2 * time.Hour)); len(ml) != 2 {
+		t.Fatal("bad expired", ml)
+	}
+	if bag := m.doQueryMsg(testOwner); len(bag.Messages) != 0 {
+		t.Fatal("expired messages must be removed", bag.Messages)
+	}
+	if n := countExpire(m); n != 0 {
+		t.Fatal("expire index must be removed", n)
+	}
+}
+
+func countExpire(m *mailbox) int {
+	var (
+		n      = 0
+		prefix = []byte(expire_prefix)
+		it     = m.db.NewIterator()
+	)
+	defer it.Release()
+	for ok := it.Seek(prefix); ok && bytes.HasPrefix(it.Key(), prefix); ok = it.Next() {
+		n++
+	}
+	return n
+}
+
+func TestMailboxRePut(t *testing.T) {
+	m := newTestMailbox(t)
+	m.ttl = time.Hour
+	msg := NewNormalMessage(testMember2, testOwner, "hello")
+	for i := 0; i < 3; i++ {
+		if err := m.putMsg(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := countExpire(m); n != 1 {
+		t.Fatal("re-put must not add expire index", n)
+	}
+	if u := m.usage(testOwner.Peerid()); u.Count != 1 {
+		t.Fatal("re-put must be counted once", u)
+	}
+	if ml := m.sweep(time.Now().Add(2 * time.Hour)); len(ml) != 1 {
+		t.Fatal("bad expired", ml)
+	}
+	if n := countExpire(m); n != 0 {
+		t.Fatal("expire index must be removed", n)
+	}
+}
@@ -0,0 +1,105 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"errors"
+	"github.com/cc14514/go-alibp2p"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"log"
+	"sort"
+)
+
+// PubsubMsg 的 topic 放在 Payload.Attrs 中，libp2p 的 topic 会加上 PUBSUB_TOPIC_PREFIX
+const (
+	PUBSUB_TOPIC_ATTR   = "topic"
+	PUBSUB_TOPIC_PREFIX = "/chat/pubsub/"
+)
+
+func NewPubsubMessage(from JID, topic, content string, attr ...Attr) *Message {
+	return newMessage(from, "", "", content, PubsubMsg, append(attr, Attr{Key: PUBSUB_TOPIC_ATTR, Val: topic})...)
+}
+
+func decodePubsubMsg(data []byte) (*Message, error) {
+	msg, err := new(Message).FromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	message := msg.(*Message)
+	if message.Envelope.Type != PubsubMsg {
+		return nil, errors.New("not pubsub message")
+	}
+	return message, message.Verify()
+}
+
+// 只转发验签通过、并且 from 与 libp2p 中的发布人一致的消息
+func pubsubValidator(from, _ peer.ID, data []byte) bool {
+	msg, err := decodePubsubMsg(data)
+	if err != nil {
+		return false
+	}
+	return msg.Envelope.From.Peerid() == from.Pretty()
+}
+
+// 订阅 topic ，收到的消息和普通消息一样交给 MsgHandle
+func (c *ChatService) Subscribe(topic string) error {
+	if topic == "" {
+		return errors.New("topic not be nil")
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.topics[topic]; ok {
+		return nil
+	}
+	err := c.p2pservice.Pubsub().Subscribe(PUBSUB_TOPIC_PREFIX+topic, func(from, _ peer.ID, data []byte) {
+		// 自己发布的不再推给自己
+		if from.Pretty() == c.myid.Peerid() {
+			return
+		}
+		msg, err := decodePubsubMsg(data)
+		if err != nil {
+			log.Println("pubsub error", "topic", topic, "from", from.Pretty(), "err", err)
+			return
+		}
+		c.deliver(msg)
+	}, alibp2p.WithValidator(pubsubValidator))
+	if err != nil {
+		return err
+	}
+	c.topics[topic] = struct{}{}
+	return nil
+}
+
+func (c *ChatService) Unsubscribe(topic string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.topics[topic]; !ok {
+		return errors.New("topic not subscribed")
+	}
+	delete(c.topics, topic)
+	return c.p2pservice.Pubsub().Unsubscribe(PUBSUB_TOPIC_PREFIX + topic)
+}
+
+func (c *ChatService) Topics() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	topics := make([]string, 0, len(c.topics))
+	for t := range c.topics {
+		topics = append(topics, t)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// 发布前需要加入 topic ，没有订阅过的会先订阅
+func (c *ChatService) Publish(topic, content string, attr ...Attr) (*Message, error) {
+	if err := c.Subscribe(topic); err != nil {
+		return nil, err
+	}
+	msg := NewPubsubMessage(c.myid, topic, content, attr...)
+	if err := c.signMsg(msg); err != nil {
+		return nil, err
+	}
+	return msg, c.p2pservice.Pubsub().Publish(PUBSUB_TOPIC_PREFIX+topic, msg.Bytes())
+}
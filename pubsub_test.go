@@ -0,0 +1,39 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"github.com/libp2p/go-libp2p-core/peer"
+	"testing"
+)
+
+func TestPubsubValidator(t *testing.T) {
+	var (
+		key, id  = newTestKey(t)
+		_, other = newTestKey(t)
+		msg      = NewPubsubMessage(JID(id), "news", "hello")
+	)
+	if topic, _ := msg.Payload.GetAttr(PUBSUB_TOPIC_ATTR); topic != "news" {
+		t.Fatal("bad topic", msg.Payload.Attrs)
+	}
+	from, _ := peer.Decode(id)
+	otherFrom, _ := peer.Decode(other)
+	if pubsubValidator(from, from, msg.Bytes()) {
+		t.Fatal("unsigned message must be rejected")
+	}
+	if err := msg.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	if !pubsubValidator(from, otherFrom, msg.Bytes()) {
+		t.Fatal("signed message must be accepted")
+	}
+	if pubsubValidator(otherFrom, otherFrom, msg.Bytes()) {
+		t.Fatal("message relayed as other publisher must be rejected")
+	}
+	nmsg := NewNormalMessage(JID(id), JID(other), "hello")
+	nmsg.Sign(key)
+	if pubsubValidator(from, from, nmsg.Bytes()) {
+		t.Fatal("normal message must be rejected")
+	}
+}
@@ -0,0 +1,209 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"errors"
+	"github.com/cc14514/go-achat-node/ldb"
+	"github.com/tendermint/go-amino"
+	"log"
+	"path"
+	"sync"
+	"time"
+)
+
+/*
+发送队列：第一次投递失败的消息保存在 homedir/outbox 中（key 为消息 id），
+按指数退避重试，直到投递成功或超过 queueTTL ；
+每次状态变化都会推一条 SysMsg 给 handler ：event = SEND_EVENT ，msgid 为消息 id ，status 为发送状态，失败时带 error
+*/
+
+const (
+	SEND_EVENT       = "send"
+	SEND_STATUS_ATTR = "status"
+	SEND_ERROR_ATTR  = "error"
+
+	SEND_QUEUED  = "queued"
+	SEND_DIRECT  = "sent-direct"
+	SEND_MAILBOX = "sent-mailbox"
+	SEND_FAILED  = "failed"
+)
+
+var (
+	queueTTL   = 24 * time.Hour
+	retryBase  = 2 * time.Second
+	retryMax   = 5 * time.Minute
+	retryCheck = time.Second
+)
+
+type (
+	QueuedMsg struct {
+		Msg      *Message
+		Attempts int
+		Next     int64 // 下次重试的时间，毫秒
+		Expire   int64 // 过期时间，毫秒
+		Err      string
+	}
+
+	sendQueue struct {
+		lock     sync.Mutex
+		db       *ldb.LDBDatabase
+		inflight map[string]struct{}
+	}
+)
+
+// 第 n 次失败以后的等待时间
+func backoff(n int) time.Duration {
+	d := retryBase
+	for i := 1; i < n && d < retryMax; i++ {
+		d *= 2
+	}
+	if d > retryMax {
+		d = retryMax
+	}
+	return d
+}
+
+// 第一次投递失败时是否进入发送队列：只重试可以重试的错误，接收人 mailbox 已满时直接返回给调用方
+func queueable(msg *Message, err error) bool {
+	switch msg.Envelope.Type {
+	case NormalMsg, SyncMsg, GroupMsg:
+		return IsRetryable(err) && !errors.Is(err, ErrMailboxFull)
+	}
+	return false
+}
+
+func newSendQueue(homedir string) *sendQueue {
+	db, err := ldb.NewLDBDatabase(path.Join(homedir, "outbox"), 0, 0)
+	if err != nil {
+		panic(err)
+	}
+	return &sendQueue{db: db, inflight: make(map[string]struct{})}
+}
+
+func (q *sendQueue) put(qm *QueuedMsg) error {
+	return q.db.Put([]byte(qm.Msg.Envelope.Id), mustToByte(qm))
+}
+
+// 删除并结束重试
+func (q *sendQueue) done(id string, del bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	delete(q.inflight, id)
+	if del {
+		q.db.Delete([]byte(id))
+	}
+}
+
+// 取出到期需要重试的消息，取出的消息在 done 之前不会再被取出
+func (q *sendQueue) due(now time.Time) []*QueuedMsg {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	var (
+		ml = make([]*QueuedMsg, 0)
+		it = q.db.NewIterator()
+	)
+	defer it.Release()
+	for it.Next() {
+		qm := new(QueuedMsg)
+		if err := amino.UnmarshalBinaryLengthPrefixed(it.Value(), qm); err != nil || qm.Msg == nil {
+			log.Println("sendQueue decode error", "id", string(it.Key()), "err", err)
+			continue
+		}
+		if _, ok := q.inflight[qm.Msg.Envelope.Id]; ok || qm.Next > now.UnixMilli() {
+			continue
+		}
+		q.inflight[qm.Msg.Envelope.Id] = struct{}{}
+		ml = append(ml, qm)
+	}
+	return ml
+}
+
+func (q *sendQueue) list() []*QueuedMsg {
+	var (
+		ml = make([]*QueuedMsg, 0)
+		it = q.db.NewIterator()
+	)
+	defer it.Release()
+	for it.Next() {
+		qm := new(QueuedMsg)
+		if err := amino.UnmarshalBinaryLengthPrefixed(it.Value(), qm); err == nil && qm.Msg != nil {
+			ml = append(ml, qm)
+		}
+	}
+	return ml
+}
+
+// 失败一次以后更新下次重试的时间，过期时返回 false
+func (qm *QueuedMsg) failed(now time.Time, err error) bool {
+	qm.Attempts++
+	qm.Err = err.Error()
+	qm.Next = now.Add(backoff(qm.Attempts)).UnixMilli()
+	return now.UnixMilli() < qm.Expire
+}
+
+func (c *ChatService) enqueue(msg *Message, err error) error {
+	now := time.Now()
+	qm := &QueuedMsg{Msg: msg, Expire: now.Add(queueTTL).UnixMilli()}
+	qm.failed(now, err)
+	log.Println("sendMsg queued", "id", msg.Envelope.Id, "to", msg.Envelope.To, "err", err)
+	return c.queue.put(qm)
+}
+
+func (c *ChatService) retry(qm *QueuedMsg) {
+	status, err := c.deliverMsg(qm.Msg)
+	if err == nil {
+		c.queue.done(qm.Msg.Envelope.Id, true)
+		c.reportStatus(qm.Msg, status, nil)
+		return
+	}
+	if !IsRetryable(err) || !qm.failed(time.Now(), err) {
+		log.Println("sendMsg failed", "id", qm.Msg.Envelope.Id, "attempts", qm.Attempts, "err", err)
+		c.queue.done(qm.Msg.Envelope.Id, true)
+		c.reportStatus(qm.Msg, SEND_FAILED, err)
+		return
+	}
+	if err := c.queue.put(qm); err != nil {
+		log.Println("sendQueue put error", "id", qm.Msg.Envelope.Id, "err", err)
+	}
+	c.queue.done(qm.Msg.Envelope.Id, false)
+}
+
+func (c *ChatService) retryLoop() {
+	timer := time.NewTicker(retryCheck)
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-c.stop:
+			return
+		case now := <-timer.C:
+			for _, qm := range c.queue.due(now) {
+				go c.retry(qm)
+			}
+		}
+	}
+}
+
+// 只通知 NormalMsg 和 GroupMsg 的发送状态
+func (c *ChatService) reportStatus(msg *Message, status string, err error) {
+	if msg.Envelope.Type != NormalMsg && msg.Envelope.Type != GroupMsg {
+		return
+	}
+	attrs := []Attr{
+		{Key: SYNC_EVENT_ATTR, Val: SEND_EVENT},
+		{Key: SYNC_MSGID_ATTR, Val: msg.Envelope.Id},
+		{Key: SEND_STATUS_ATTR, Val: status},
+	}
+	if err != nil {
+		attrs = append(attrs, Attr{Key: SEND_ERROR_ATTR, Val: err.Error()})
+	}
+	go c.deliver(NewSysMessage("", attrs...))
+}
+
+// 还在队列中等待重试的消息
+func (c *ChatService) QueuedMsgs() []*QueuedMsg {
+	return c.queue.list()
+}
@@ -0,0 +1,69 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	for n, d := range map[int]time.Duration{1: retryBase, 2: 2 * retryBase, 3: 4 * retryBase, 100: retryMax} {
+		if backoff(n) != d {
+			t.Fatal("bad backoff", n, backoff(n), d)
+		}
+	}
+}
+
+func TestQueueable(t *testing.T) {
+	msg := NewNormalMessage(testOwner, testMember2, "hello")
+	if !queueable(msg, newResponse(RSP_RATE_LIMITED, ErrRateLimited).Err()) {
+		t.Fatal("rate limited must be queued")
+	}
+	if queueable(msg, newResponse(RSP_MAILBOX_FULL, ErrMailboxFull).Err()) || queueable(msg, ErrMailboxFull) {
+		t.Fatal("mailbox full must be returned to the caller")
+	}
+	if queueable(NewSysMessage("", Attr{Key: "k", Val: "v"}), ErrRateLimited) {
+		t.Fatal("sys message must not be queued")
+	}
+}
+
+func TestSendQueue(t *testing.T) {
+	var (
+		q   = newSendQueue(t.TempDir())
+		now = time.Now()
+		msg = NewNormalMessage(testOwner, testMember2, "hello")
+		qm  = &QueuedMsg{Msg: msg, Expire: now.Add(time.Minute).UnixMilli()}
+	)
+	if !qm.failed(now, errors.New("offline")) || qm.Attempts != 1 || qm.Err != "offline" {
+		t.Fatal("bad failed", qm)
+	}
+	if err := q.put(qm); err != nil {
+		t.Fatal(err)
+	}
+	if ml := q.due(now); len(ml) != 0 {
+		t.Fatal("not due yet", ml)
+	}
+	later := now.Add(retryBase)
+	ml := q.due(later)
+	if len(ml) != 1 || ml[0].Msg.Envelope.Id != msg.Envelope.Id || ml[0].Attempts != 1 {
+		t.Fatal("bad due", ml)
+	}
+	// 重试中的消息不会重复取出
+	if ml := q.due(later); len(ml) != 0 {
+		t.Fatal("inflight message must be skipped", ml)
+	}
+	q.done(msg.Envelope.Id, false)
+	if len(q.list()) != 1 {
+		t.Fatal("message must stay queued")
+	}
+	q.done(msg.Envelope.Id, true)
+	if ml := q.due(later); len(ml) != 0 {
+		t.Fatal("message must be removed", ml)
+	}
+	if qm.failed(now.Add(2*time.Minute), errors.New("offline")) {
+		t.Fatal("message must expire")
+	}
+}
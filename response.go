@@ -0,0 +1,152 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/tendermint/go-amino"
+	"io"
+)
+
+/*
+PID_NORMAL / PID_RTP / PID_MAILBOX / PID_MAILBOX_CLEAN / PID_MAILBOX_GROUP_MSG / PID_MAILBOX_BLOB 的响应为 Response ，查询的响应在 MessageBag 中带 Code 和 Retryable ；
+调用方收到 Code != RSP_OK 时得到 *RspError ，可以用 errors.Is 和 ErrMailboxFull 等比较，
+旧版本节点返回的 SUCCESS 或错误字符串按原来的方式处理
+*/
+
+const (
+	RSP_OK             = 0
+	RSP_BAD_REQUEST    = 1 // 请求无法解析
+	RSP_UNAUTHORIZED   = 2 // 验签失败
+	RSP_NOT_REGISTERED = 3 // 接收人没有绑定这个 mailbox
+	RSP_MAILBOX_FULL   = 4
+	RSP_RATE_LIMITED   = 5
+	RSP_NOT_SUPPORT    = 6
+	RSP_INTERNAL       = 7  // 存储等内部错误，稍后可以重试
+	RSP_BUSY           = 8  // 被叫正在通话
+	RSP_FORBIDDEN      = 9  // 签名正确但没有权限：不是本人、不是群成员、发送人和连接不符
+	RSP_REJECTED       = 10 // 其他原因拒绝，重试也不会成功
+)
+
+type (
+	Response struct {
+		Code      int
+		Message   string
+		Retryable bool // 稍后重试可能成功
+	}
+
+	// 对方返回的错误
+	RspError struct {
+		Code      int
+		Message   string
+		Retryable bool
+	}
+)
+
+// 错误码对应的本地错误，用于 errors.Is
+var rspErrors = map[int]error{
+	RSP_UNAUTHORIZED:   errBadSignature,
+	RSP_FORBIDDEN:      errPermissionDenied,
+	RSP_NOT_REGISTERED: errNotRegistered,
+	RSP_MAILBOX_FULL:   ErrMailboxFull,
+	RSP_RATE_LIMITED:   ErrRateLimited,
+	RSP_BUSY:           errCallBusy,
+}
+
+func (e *RspError) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+func (e *RspError) Is(target error) bool {
+	return target != nil && rspErrors[e.Code] == target
+}
+
+func retryable(code int) bool {
+	switch code {
+	case RSP_MAILBOX_FULL, RSP_RATE_LIMITED, RSP_INTERNAL:
+		return true
+	}
+	return false
+}
+
+// 本地错误对应的错误码，未知的错误按 RSP_REJECTED 处理，不会重试；可以重试的内部错误由调用方指定 RSP_INTERNAL
+func rspCode(err error) int {
+	if err == nil {
+		return RSP_OK
+	}
+	for code, e := range rspErrors {
+		if errors.Is(err, e) {
+			return code
+		}
+	}
+	return RSP_REJECTED
+}
+
+func newResponse(code int, err error) *Response {
+	if err == nil {
+		return &Response{Code: code}
+	}
+	return &Response{Code: code, Message: err.Error(), Retryable: retryable(code)}
+}
+
+func (r *Response) Err() error {
+	if r.Code == RSP_OK {
+		return nil
+	}
+	return &RspError{Code: r.Code, Message: r.Message, Retryable: r.Retryable}
+}
+
+// code 为 RSP_OK 时 err 为 nil
+func writeRsp(w io.Writer, code int, err error) error {
+	_, werr := w.Write(mustToByte(newResponse(code, err)))
+	return werr
+}
+
+// 解析 writeRsp 的响应
+func readRsp(rtn []byte) error {
+	if bytes.Equal(rtn, SUCCESS) {
+		return nil
+	}
+	rsp := new(Response)
+	if err := amino.UnmarshalBinaryLengthPrefixed(rtn, rsp); err != nil {
+		return mailboxError(rtn)
+	}
+	return rsp.Err()
+}
+
+func (bag *MessageBag) setErr(code int, err error) *MessageBag {
+	bag.Code, bag.Err, bag.Retryable = code, err.Error(), retryable(code)
+	return bag
+}
+
+func (bag *MessageBag) error() error {
+	if bag.Err == "" {
+		return nil
+	}
+	code := bag.Code
+	if code == RSP_OK {
+		code = RSP_INTERNAL
+	}
+	return &RspError{Code: code, Message: bag.Err, Retryable: bag.Retryable}
+}
+
+// 网络错误和 Retryable 的 RspError 可以重试
+func IsRetryable(err error) bool {
+	// errors.Join 的错误有一个可以重试就可以重试
+	if errs, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, e := range errs.Unwrap() {
+			if IsRetryable(e) {
+				return true
+			}
+		}
+		return false
+	}
+	var rerr *RspError
+	if errors.As(err, &rerr) {
+		return rerr.Retryable
+	}
+	return err != nil
+}
@@ -0,0 +1,65 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestResponse(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeRsp(&buf, RSP_OK, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := readRsp(buf.Bytes()); err != nil {
+		t.Fatal("bad ok response", err)
+	}
+
+	buf.Reset()
+	writeRsp(&buf, rspCode(ErrMailboxFull), ErrMailboxFull)
+	err := readRsp(buf.Bytes())
+	var rerr *RspError
+	if !errors.As(err, &rerr) || rerr.Code != RSP_MAILBOX_FULL || !errors.Is(err, ErrMailboxFull) || errors.Is(err, ErrRateLimited) {
+		t.Fatal("bad mailbox full response", err)
+	}
+	if !IsRetryable(err) {
+		t.Fatal("mailbox full is retryable")
+	}
+
+	buf.Reset()
+	writeRsp(&buf, RSP_UNAUTHORIZED, errBadSignature)
+	if err = readRsp(buf.Bytes()); !errors.Is(err, errBadSignature) || IsRetryable(err) {
+		t.Fatal("bad unauthorized response", err)
+	}
+	buf.Reset()
+	writeRsp(&buf, rspCode(errPermissionDenied), errPermissionDenied)
+	if err := readRsp(buf.Bytes()); !errors.Is(err, errPermissionDenied) || errors.Is(err, errBadSignature) || IsRetryable(err) {
+		t.Fatal("bad forbidden response", err)
+	}
+	if code := rspCode(errors.New("unknown")); code != RSP_REJECTED || retryable(code) {
+		t.Fatal("unknown error must not be retryable", code)
+	}
+	// 网络错误可以重试，errors.Join 中有一个可以重试就可以重试
+	if !IsRetryable(errors.New("timeout")) || !IsRetryable(errors.Join(err, errors.New("timeout"))) || IsRetryable(errors.Join(err, err)) {
+		t.Fatal("bad retryable")
+	}
+
+	// 旧版本的响应
+	if readRsp(SUCCESS) != nil || readRsp([]byte(ErrRateLimited.Error())) != ErrRateLimited {
+		t.Fatal("bad legacy response")
+	}
+	if err = readRsp([]byte("recipient not registered")); err == nil {
+		t.Fatal("legacy error must not be nil")
+	}
+
+	bag := new(MessageBag).setErr(RSP_NOT_REGISTERED, errNotRegistered)
+	if err = bag.error(); !errors.Is(err, errNotRegistered) || IsRetryable(err) {
+		t.Fatal("bad bag error", err)
+	}
+	if (&MessageBag{Err: "legacy"}).error() == nil || new(MessageBag).error() != nil {
+		t.Fatal("bad legacy bag error")
+	}
+}
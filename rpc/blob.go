@@ -0,0 +1,85 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package rpc
+
+import (
+	"fmt"
+	chat "github.com/cc14514/go-achat-node"
+)
+
+type BlobService struct {
+	chatservice *chat.ChatService
+}
+
+func NewBlobService(chatservice *chat.ChatService) Service {
+	return &BlobService{chatservice: chatservice}
+}
+
+// params = [path, mime] ，mime 可选，为空时按扩展名判断
+func (b *BlobService) Upload(req *Req) *Rsp {
+	fmt.Println("blob.upload -->", req)
+	p, err := X2Str(req.Params)
+	if err != nil || len(p) < 1 {
+		return NewRsp(req.Id, nil, &RspError{Code: "10000", Message: "path not nil"})
+	}
+	var mime string
+	if len(p) > 1 {
+		mime = p[1]
+	}
+	blob, err := b.chatservice.PutBlob(p[0], mime)
+	if err != nil {
+		return NewRsp(req.Id, nil, &RspError{Code: "10001", Message: err.Error()})
+	}
+	rsp := NewRsp(req.Id, blob, nil)
+	fmt.Println("blob.upload <--", rsp)
+	return rsp
+}
+
+// params = [jid, hash, content, name, mime] ，content / name / mime 可选，返回消息 id
+func (b *BlobService) Send(req *Req) *Rsp {
+	fmt.Println("blob.send -->", req)
+	p, err := X2Str(req.Params)
+	if err != nil || len(p) < 2 {
+		return NewRsp(req.Id, nil, &RspError{Code: "20000", Message: "jid / hash not nil"})
+	}
+	for len(p) < 5 {
+		p = append(p, "")
+	}
+	msg, err := b.chatservice.SendBlob(chat.JID(p[0]), &chat.Blob{Hash: p[1], Name: p[3], Mime: p[4]}, p[2])
+	if err != nil {
+		return NewRsp(req.Id, nil, &RspError{Code: "20001", Message: err.Error()})
+	}
+	return NewRsp(req.Id, msg.Envelope.Id, nil)
+}
+
+// params = [hash, jid] ，jid 为发送人，返回本地文件路径
+func (b *BlobService) Download(req *Req) *Rsp {
+	fmt.Println("blob.download -->", req)
+	p, err := X2Str(req.Params)
+	if err != nil || len(p) < 1 {
+		return NewRsp(req.Id, nil, &RspError{Code: "30000", Message: "hash not nil"})
+	}
+	var from chat.JID
+	if len(p) > 1 {
+		from = chat.JID(p[1])
+	}
+	fn, err := b.chatservice.GetBlob(from, p[0])
+	if err != nil {
+		return NewRsp(req.Id, nil, &RspError{Code: "30001", Message: err.Error()})
+	}
+	rsp := NewRsp(req.Id, fn, nil)
+	fmt.Println("blob.download <--", rsp)
+	return rsp
+}
+
+func (b *BlobService) APIs() *API {
+	return &API{
+		Namespace: "blob",
+		Api: map[string]RpcFn{
+			"upload":   b.Upload,
+			"send":     b.Send,
+			"download": b.Download,
+		},
+	}
+}
@@ -8,12 +8,16 @@
 package rpc
 
 import (
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	chat "github.com/cc14514/go-achat-node"
 	"github.com/cc14514/go-achat-node/ldb"
 	"github.com/tendermint/go-amino"
 	"path"
+	"strconv"
+	"strings"
 )
 
 type groupBean chat.Group
@@ -84,11 +88,206 @@ func (g GroupService) Create(req *Req) *Rsp {
 
 }
 
+func (g GroupService) Sendmsg(req *Req) *Rsp {
+	fmt.Println("group.sendmsg -->", req)
+	if len(req.Params) < 2 {
+		return NewRsp(req.Id, nil, &RspError{Code: "20000", Message: "gid / content not nil"})
+	}
+	p, err := X2Str(req.Params)
+	if err != nil {
+		return NewRsp(req.Id, nil, &RspError{Code: "20001", Message: err.Error()})
+	}
+	msg := chat.NewGroupMessage(g.chatservice.GetMyid(), chat.GID(p[0]), strings.Join(p[1:], " "))
+	if err := g.chatservice.SendMsg(msg); err != nil {
+		return NewRsp(req.Id, nil, &RspError{Code: "20002", Message: err.Error()})
+	}
+	rsp := NewRsp(req.Id, "success", nil)
+	fmt.Println("group.sendmsg <--", rsp)
+	return rsp
+}
+
+// 成员参数可以是 jid 字符串或者 {"id":"jid","name":"name"}
+func toMembers(params []interface{}) ([]*chat.GroupMember, error) {
+	members := make([]*chat.GroupMember, 0)
+	for _, p := range params {
+		switch m := p.(type) {
+		case string:
+			members = append(members, &chat.GroupMember{Id: chat.JID(m)})
+		case map[string]interface{}:
+			id, _ := m["id"].(string)
+			name, _ := m["name"].(string)
+			if id == "" {
+				return nil, errors.New("member id not nil")
+			}
+			members = append(members, &chat.GroupMember{Id: chat.JID(id), Name: name})
+		default:
+			return nil, errors.New("error member")
+		}
+	}
+	return members, nil
+}
+
+func (g GroupService) Get(req *Req) *Rsp {
+	fmt.Println("group.get -->", req)
+	if len(req.Params) < 1 {
+		return NewRsp(req.Id, nil, &RspError{Code: "50000", Message: "gid not nil"})
+	}
+	gid, _ := req.Params[0].(string)
+	grsp, err := g.chatservice.GetGroup(chat.GID(gid))
+	if err != nil {
+		return NewRsp(req.Id, nil, &RspError{Code: "50001", Message: err.Error()})
+	}
+	rsp := NewRsp(req.Id, grsp, nil)
+	fmt.Println("group.get <--", rsp)
+	return rsp
+}
+
+// params = [gid, member, member, ...]
+func (g GroupService) Addmember(req *Req) *Rsp {
+	fmt.Println("group.addmember -->", req)
+	if len(req.Params) < 2 {
+		return NewRsp(req.Id, nil, &RspError{Code: "60000", Message: "gid / members not nil"})
+	}
+	gid, _ := req.Params[0].(string)
+	members, err := toMembers(req.Params[1:])
+	if err != nil {
+		return NewRsp(req.Id, nil, &RspError{Code: "60001", Message: err.Error()})
+	}
+	if err = g.chatservice.AddMembers(chat.GID(gid), members...); err != nil {
+		return NewRsp(req.Id, nil, &RspError{Code: "60002", Message: err.Error()})
+	}
+	rsp := NewRsp(req.Id, "success", nil)
+	fmt.Println("group.addmember <--", rsp)
+	return rsp
+}
+
+// params = [gid, jid, jid, ...]
+func (g GroupService) Delmember(req *Req) *Rsp {
+	fmt.Println("group.delmember -->", req)
+	if len(req.Params) < 2 {
+		return NewRsp(req.Id, nil, &RspError{Code: "70000", Message: "gid / members not nil"})
+	}
+	gid, _ := req.Params[0].(string)
+	members, err := toMembers(req.Params[1:])
+	if err != nil {
+		return NewRsp(req.Id, nil, &RspError{Code: "70001", Message: err.Error()})
+	}
+	ids := make([]chat.JID, 0, len(members))
+	for _, m := range members {
+		ids = append(ids, m.Id)
+	}
+	if err = g.chatservice.RemoveMembers(chat.GID(gid), ids...); err != nil {
+		return NewRsp(req.Id, nil, &RspError{Code: "70002", Message: err.Error()})
+	}
+	rsp := NewRsp(req.Id, "success", nil)
+	fmt.Println("group.delmember <--", rsp)
+	return rsp
+}
+
+// params = [gid, from, action] , action 为 "f"（向后，默认）或 "t"（向前）
+func (g GroupService) Members(req *Req) *Rsp {
+	fmt.Println("group.members -->", req)
+	if len(req.Params) < 1 {
+		return NewRsp(req.Id, nil, &RspError{Code: "80000", Message: "gid not nil"})
+	}
+	p, err := X2Str(req.Params)
+	if err != nil {
+		return NewRsp(req.Id, nil, &RspError{Code: "80001", Message: err.Error()})
+	}
+	var (
+		from   chat.JID
+		action = chat.FROM
+	)
+	if len(p) > 1 {
+		from = chat.JID(p[1])
+	}
+	if len(p) > 2 {
+		action = chat.MemberAction(p[2])
+	}
+	members, err := g.chatservice.ListMembers(chat.GID(p[0]), from, action)
+	if err != nil {
+		return NewRsp(req.Id, nil, &RspError{Code: "80002", Message: err.Error()})
+	}
+	rsp := NewRsp(req.Id, members, nil)
+	fmt.Println("group.members <--", rsp)
+	return rsp
+}
+
+func (g GroupService) Drop(req *Req) *Rsp {
+	fmt.Println("group.drop -->", req)
+	if len(req.Params) < 1 {
+		return NewRsp(req.Id, nil, &RspError{Code: "40000", Message: "gid not nil"})
+	}
+	gid, _ := req.Params[0].(string)
+	grsp, err := g.chatservice.DropGroup(chat.GID(gid))
+	if err != nil {
+		return NewRsp(req.Id, nil, &RspError{Code: "40001", Message: err.Error()})
+	}
+	if delFn := getRpcFn("user_del"); delFn != nil {
+		delFn(&Req{Params: []interface{}{gid}})
+	}
+	rsp := NewRsp(req.Id, grsp, nil)
+	fmt.Println("group.drop <--", rsp)
+	return rsp
+}
+
+// params = [gid, from, limit] , from 为 hex 编码的 hash，为空时从最新一条开始
+func (g GroupService) History(req *Req) *Rsp {
+	fmt.Println("group.history -->", req)
+	if len(req.Params) < 1 {
+		return NewRsp(req.Id, nil, &RspError{Code: "30000", Message: "gid not nil"})
+	}
+	var (
+		gid, _ = req.Params[0].(string)
+		from   []byte
+		limit  int
+		err    error
+	)
+	if len(req.Params) > 1 {
+		if h, ok := req.Params[1].(string); ok {
+			if from, err = hex.DecodeString(h); err != nil {
+				return NewRsp(req.Id, nil, &RspError{Code: "30001", Message: err.Error()})
+			}
+		}
+	}
+	if len(req.Params) > 2 {
+		switch l := req.Params[2].(type) {
+		case float64:
+			limit = int(l)
+		case string:
+			limit, _ = strconv.Atoi(l)
+		}
+	}
+	hrsp, err := g.chatservice.GroupHistory(chat.GID(gid), from, limit)
+	if err != nil {
+		return NewRsp(req.Id, nil, &RspError{Code: "30002", Message: err.Error()})
+	}
+	entity := struct {
+		Head     string          `json:"head,omitempty"`
+		Next     string          `json:"next,omitempty"`
+		Messages []*chat.Message `json:"messages"`
+	}{Head: hex.EncodeToString(hrsp.Head), Messages: make([]*chat.Message, 0)}
+	for _, gm := range hrsp.Messages {
+		entity.Messages = append(entity.Messages, gm.Msg)
+		entity.Next = hex.EncodeToString(gm.ParentHash)
+	}
+	rsp := NewRsp(req.Id, entity, nil)
+	fmt.Println("group.history <--", rsp)
+	return rsp
+}
+
 func (g GroupService) APIs() *API {
 	return &API{
 		Namespace: "group",
 		Api: map[string]RpcFn{
-			"create": g.Create,
+			"create":    g.Create,
+			"sendmsg":   g.Sendmsg,
+			"history":   g.History,
+			"drop":      g.Drop,
+			"get":       g.Get,
+			"addmember": g.Addmember,
+			"delmember": g.Delmember,
+			"members":   g.Members,
 		},
 	}
 }
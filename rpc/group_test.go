@@ -0,0 +1,27 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package rpc
+
+import (
+	"testing"
+)
+
+func TestToMembers(t *testing.T) {
+	members, err := toMembers([]interface{}{
+		"16Uiu2HAmN2eZ9DLJhccS1R49Qc1tpdGMdbC8uWwzUCUAfRpRvEvd",
+		map[string]interface{}{"id": "16Uiu2HAkvsWx5Byt8RCXs2ScrmPCZteHjcdQhzxdHCVYTjtYxPYr", "name": "b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 2 || members[1].Name != "b" || members[0].Id != "16Uiu2HAmN2eZ9DLJhccS1R49Qc1tpdGMdbC8uWwzUCUAfRpRvEvd" {
+		t.Fatal("bad members", members)
+	}
+	if _, err = toMembers([]interface{}{map[string]interface{}{"name": "b"}}); err == nil {
+		t.Fatal("member without id must fail")
+	}
+	if _, err = toMembers([]interface{}{1.0}); err == nil {
+		t.Fatal("number must fail")
+	}
+}
@@ -0,0 +1,78 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package rpc
+
+import (
+	"fmt"
+	chat "github.com/cc14514/go-achat-node"
+	"strconv"
+)
+
+type HistoryService struct {
+	chatservice *chat.ChatService
+}
+
+func NewHistoryService(chatservice *chat.ChatService) Service {
+	return &HistoryService{chatservice: chatservice}
+}
+
+// 数字参数可以是 number 也可以是 string
+func x2Int64(v interface{}) int64 {
+	switch n := v.(type) {
+	case float64:
+		return int64(n)
+	case string:
+		i, _ := strconv.ParseInt(n, 10, 64)
+		return i
+	}
+	return 0
+}
+
+// params = [jid, before, limit] ，before 为秒级时间戳，可选
+func (h *HistoryService) Query(req *Req) *Rsp {
+	fmt.Println("history.query -->", req)
+	rsp := h.query(req, func(peer string, before int64, limit int) []*chat.Message {
+		return h.chatservice.History(chat.JID(peer), before, limit)
+	})
+	fmt.Println("history.query <--", rsp)
+	return rsp
+}
+
+// params = [gid, before, limit]
+func (h *HistoryService) Group(req *Req) *Rsp {
+	fmt.Println("history.group -->", req)
+	rsp := h.query(req, func(peer string, before int64, limit int) []*chat.Message {
+		return h.chatservice.LocalGroupHistory(chat.GID(peer), before, limit)
+	})
+	fmt.Println("history.group <--", rsp)
+	return rsp
+}
+
+func (h *HistoryService) query(req *Req, fn func(peer string, before int64, limit int) []*chat.Message) *Rsp {
+	if len(req.Params) < 1 {
+		return NewRsp(req.Id, nil, &RspError{Code: "10000", Message: "peer not nil"})
+	}
+	peer, ok := req.Params[0].(string)
+	if !ok || peer == "" {
+		return NewRsp(req.Id, nil, &RspError{Code: "10001", Message: "peer must be string"})
+	}
+	var before, limit int64
+	if len(req.Params) > 1 {
+		before = x2Int64(req.Params[1])
+	}
+	if len(req.Params) > 2 {
+		limit = x2Int64(req.Params[2])
+	}
+	return NewRsp(req.Id, fn(peer, before, int(limit)), nil)
+}
+
+func (h *HistoryService) APIs() *API {
+	return &API{
+		Namespace: "history",
+		Api: map[string]RpcFn{
+			"query": h.Query,
+			"group": h.Group,
+		},
+	}
+}
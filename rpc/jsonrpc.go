@@ -0,0 +1,196 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+JSON-RPC 2.0 模式：请求中带 "jsonrpc":"2.0" 或者是批量请求（数组）时使用，
+token 通过 Authorization: Bearer <token> 传递，token 由 auth 方法获得；
+错误码为数字，接口自己的错误码（如 "1003"）转成对应的数字，没有 id 的请求为通知，不返回响应
+*/
+
+const (
+	JSONRPC_VSN = "2.0"
+
+	ERR_PARSE            = -32700
+	ERR_INVALID_REQUEST  = -32600
+	ERR_METHOD_NOT_FOUND = -32601
+	ERR_INVALID_PARAMS   = -32602
+	ERR_INTERNAL         = -32603
+)
+
+type (
+	JsonrpcReq struct {
+		Jsonrpc string          `json:"jsonrpc"`
+		Id      json.RawMessage `json:"id,omitempty"` // 没有 id 的是通知
+		Method  string          `json:"method"`
+		Params  json.RawMessage `json:"params,omitempty"`
+	}
+
+	JsonrpcError struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+
+	// result 和 error 只能有一个，成功时 result 可以是 null
+	JsonrpcRsp struct {
+		Jsonrpc string          `json:"jsonrpc"`
+		Result  interface{}     `json:"result"`
+		Error   *JsonrpcError   `json:"error,omitempty"`
+		Id      json.RawMessage `json:"id"`
+	}
+)
+
+var nullId = json.RawMessage("null")
+
+func (r *JsonrpcRsp) MarshalJSON() ([]byte, error) {
+	id := r.Id
+	if len(id) == 0 {
+		id = nullId
+	}
+	if r.Error != nil {
+		return json.Marshal(struct {
+			Jsonrpc string          `json:"jsonrpc"`
+			Error   *JsonrpcError   `json:"error"`
+			Id      json.RawMessage `json:"id"`
+		}{JSONRPC_VSN, r.Error, id})
+	}
+	return json.Marshal(struct {
+		Jsonrpc string          `json:"jsonrpc"`
+		Result  interface{}     `json:"result"`
+		Id      json.RawMessage `json:"id"`
+	}{JSONRPC_VSN, r.Result, id})
+}
+
+func newJsonrpcError(id json.RawMessage, code int, message string) *JsonrpcRsp {
+	return &JsonrpcRsp{Jsonrpc: JSONRPC_VSN, Error: &JsonrpcError{Code: code, Message: message}, Id: id}
+}
+
+// 批量请求或者带 "jsonrpc" 字段的请求
+func isJsonrpc(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		return true
+	}
+	var v struct {
+		Jsonrpc *string `json:"jsonrpc"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		// 无法解析时按是否带 "jsonrpc" 判断，返回 ERR_PARSE
+		return bytes.Contains(data, []byte(`"jsonrpc"`))
+	}
+	return v.Jsonrpc != nil
+}
+
+// Authorization: Bearer <token>
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// 数组原样作为 params ，对象作为第一个参数，与旧格式的接口保持一致
+func jsonrpcParams(raw json.RawMessage) ([]interface{}, bool) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, nullId) {
+		return nil, true
+	}
+	switch raw[0] {
+	case '[':
+		var params []interface{}
+		return params, json.Unmarshal(raw, &params) == nil
+	case '{':
+		var param map[string]interface{}
+		return []interface{}{param}, json.Unmarshal(raw, &param) == nil
+	}
+	return nil, false
+}
+
+// 旧格式的 id 是字符串，数字 id 转成字符串
+func legacyId(id json.RawMessage) string {
+	var s string
+	if json.Unmarshal(id, &s) == nil {
+		return s
+	}
+	return string(id)
+}
+
+func toJsonrpcRsp(id json.RawMessage, rsp *Rsp) *JsonrpcRsp {
+	if rsp.Error == nil {
+		return &JsonrpcRsp{Jsonrpc: JSONRPC_VSN, Result: rsp.Result, Id: id}
+	}
+	code, err := strconv.Atoi(rsp.Error.Code)
+	if err != nil {
+		code = ERR_INTERNAL
+	}
+	return newJsonrpcError(id, code, rsp.Error.Message)
+}
+
+// 处理一个请求，通知返回 nil
+func handleJsonrpc(token string, raw json.RawMessage) *JsonrpcRsp {
+	req := new(JsonrpcReq)
+	if err := json.Unmarshal(raw, req); err != nil {
+		return newJsonrpcError(nil, ERR_INVALID_REQUEST, "invalid request")
+	}
+	if req.Jsonrpc != JSONRPC_VSN || req.Method == "" {
+		return newJsonrpcError(req.Id, ERR_INVALID_REQUEST, "invalid request")
+	}
+	params, ok := jsonrpcParams(req.Params)
+	if !ok {
+		return newJsonrpcError(req.Id, ERR_INVALID_PARAMS, "params must be array or object")
+	}
+	var rsp *JsonrpcRsp
+	if lookupFn(req.Method) == nil {
+		rsp = newJsonrpcError(req.Id, ERR_METHOD_NOT_FOUND, "method_not_support")
+	} else {
+		rsp = toJsonrpcRsp(req.Id, call(&Req{Id: legacyId(req.Id), Token: token, Method: req.Method, Params: params}))
+	}
+	if req.Id == nil {
+		return nil
+	}
+	return rsp
+}
+
+// 单个请求返回一个响应，批量请求返回数组，全是通知时没有响应
+func serveJsonrpc(w http.ResponseWriter, token string, data []byte) {
+	data = bytes.TrimSpace(data)
+	if !json.Valid(data) {
+		json.NewEncoder(w).Encode(newJsonrpcError(nil, ERR_PARSE, "parse error"))
+		return
+	}
+	if data[0] != '[' {
+		if rsp := handleJsonrpc(token, data); rsp != nil {
+			json.NewEncoder(w).Encode(rsp)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+	var batch []json.RawMessage
+	json.Unmarshal(data, &batch)
+	if len(batch) == 0 {
+		json.NewEncoder(w).Encode(newJsonrpcError(nil, ERR_INVALID_REQUEST, "empty batch"))
+		return
+	}
+	rsps := make([]*JsonrpcRsp, 0, len(batch))
+	for _, raw := range batch {
+		if rsp := handleJsonrpc(token, raw); rsp != nil {
+			rsps = append(rsps, rsp)
+		}
+	}
+	if len(rsps) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	json.NewEncoder(w).Encode(rsps)
+}
@@ -0,0 +1,94 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package rpc
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type echoService struct{}
+
+func (e *echoService) APIs() *API {
+	return &API{
+		Namespace: "test",
+		Api: map[string]RpcFn{
+			"echo": func(req *Req) *Rsp {
+				if len(req.Params) == 0 {
+					return NewRsp(req.Id, nil, &RspError{Code: "10000", Message: "params not nil"})
+				}
+				return NewRsp(req.Id, req.Params[0], nil)
+			},
+		},
+	}
+}
+
+func serveTest(t *testing.T, token, body string) (int, string) {
+	if !isJsonrpc([]byte(body)) {
+		t.Fatal("must be jsonrpc", body)
+	}
+	w := httptest.NewRecorder()
+	serveJsonrpc(w, token, []byte(body))
+	return w.Code, w.Body.String()
+}
+
+func TestJsonrpc(t *testing.T) {
+	serviceReg(new(echoService))
+	if isJsonrpc([]byte(`{"id":"1","token":"t","method":"myid"}`)) {
+		t.Fatal("legacy request")
+	}
+
+	// auth 返回的 token 放在 Authorization 中
+	_, body := serveTest(t, "", `{"jsonrpc":"2.0","id":1,"method":"auth"}`)
+	rsp := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(body), &rsp); err != nil || rsp["id"] != 1.0 || rsp["result"] == nil {
+		t.Fatal("bad auth", body)
+	}
+	token := rsp["result"].(string)
+	req, _ := http.NewRequest(http.MethodPost, "/rpc", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if bearerToken(req) != token {
+		t.Fatal("bad bearer token")
+	}
+
+	_, body = serveTest(t, "bad", `{"jsonrpc":"2.0","id":"a","method":"test_echo","params":["x"]}`)
+	if body != `{"jsonrpc":"2.0","error":{"code":1001,"message":"error token , please relogin ."},"id":"a"}`+"\n" {
+		t.Fatal("bad token error", body)
+	}
+	_, body = serveTest(t, token, `{"jsonrpc":"2.0","id":"a","method":"test_echo","params":{"k":"v"}}`)
+	if body != `{"jsonrpc":"2.0","result":{"k":"v"},"id":"a"}`+"\n" {
+		t.Fatal("bad object params", body)
+	}
+	_, body = serveTest(t, token, `{"jsonrpc":"2.0","id":null,"method":"test_nothing"}`)
+	if body != `{"jsonrpc":"2.0","error":{"code":-32601,"message":"method_not_support"},"id":null}`+"\n" {
+		t.Fatal("bad method not found", body)
+	}
+	_, body = serveTest(t, token, `{"jsonrpc":"2.0","id":1,"method":"test_echo"`)
+	if body != `{"jsonrpc":"2.0","error":{"code":-32700,"message":"parse error"},"id":null}`+"\n" {
+		t.Fatal("bad parse error", body)
+	}
+	if code, body := serveTest(t, token, `{"jsonrpc":"2.0","method":"test_echo","params":["x"]}`); code != http.StatusNoContent || body != "" {
+		t.Fatal("notification has no response", code, body)
+	}
+
+	_, body = serveTest(t, token, `[
+		{"jsonrpc":"2.0","id":1,"method":"test_echo","params":["x"]},
+		{"jsonrpc":"2.0","method":"test_echo","params":["y"]},
+		{"jsonrpc":"2.0","id":2,"method":"test_echo"},
+		{"jsonrpc":"2.0","id":3,"method":"test_echo","params":1},
+		1
+	]`)
+	want := `[{"jsonrpc":"2.0","result":"x","id":1},` +
+		`{"jsonrpc":"2.0","error":{"code":10000,"message":"params not nil"},"id":2},` +
+		`{"jsonrpc":"2.0","error":{"code":-32602,"message":"params must be array or object"},"id":3},` +
+		`{"jsonrpc":"2.0","error":{"code":-32600,"message":"invalid request"},"id":null}]` + "\n"
+	if body != want {
+		t.Fatal("bad batch", body)
+	}
+	if _, body = serveTest(t, token, `[]`); body != `{"jsonrpc":"2.0","error":{"code":-32600,"message":"empty batch"},"id":null}`+"\n" {
+		t.Fatal("bad empty batch", body)
+	}
+}
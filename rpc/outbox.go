@@ -0,0 +1,166 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package rpc
+
+import (
+	"errors"
+	chat "github.com/cc14514/go-achat-node"
+	"github.com/cc14514/go-achat-node/ldb"
+	"log"
+	"sort"
+	"sync"
+)
+
+// 在线时收到的消息最多缓存这么多条等待客户端确认
+const maxUnacked = 1024
+
+// 通知客户端这条消息没有缓存，断线以后不会重发
+const OUTBOX_DROP_EVENT = "outbox-drop"
+
+var errOutboxFull = errors.New("outbox full")
+
+/*
+写给 websocket 客户端、还没有被确认的消息：
+mailbox 中的离线消息只记 id ，确认以后才 CleanMsg ，没有确认的下次 open 时会从 mailbox 再查出来；
+节点收到的 NormalMsg / GroupMsg / SyncMsg 不在 mailbox 中，不管有没有连接都保存在 homedir/rpc_outbox ，下次 open 时重发（重启后也会重发）；
+open 时没有声明 ack 的旧客户端不会确认，写出即视为已确认
+*/
+type outbox struct {
+	lock    sync.Mutex
+	db      *ldb.LDBDatabase
+	mailbox map[string]struct{}
+	unacked map[string]struct{} // db 中的 id
+	clients map[int]*wsClient
+	nextId  int
+}
+
+// 已经 open 的 websocket 连接
+type wsClient struct {
+	write func(*chat.Message)
+	ack   bool // 是否会按 id 确认
+}
+
+func newOutbox(dir string) *outbox {
+	db, err := ldb.NewLDBDatabase(dir, 0, 0)
+	if err != nil {
+		panic(err)
+	}
+	o := &outbox{
+		db:      db,
+		mailbox: make(map[string]struct{}),
+		unacked: make(map[string]struct{}),
+		clients: make(map[int]*wsClient),
+	}
+	it := db.NewIterator()
+	defer it.Release()
+	for it.Next() {
+		o.unacked[string(it.Key())] = struct{}{}
+	}
+	return o
+}
+
+func buffered(msg *chat.Message) bool {
+	switch msg.Envelope.Type {
+	case chat.NormalMsg, chat.GroupMsg, chat.SyncMsg:
+		return true
+	}
+	return false
+}
+
+func (o *outbox) addMailbox(id string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.mailbox[id] = struct{}{}
+}
+
+// 满了返回 errOutboxFull ，调用方要通知客户端
+func (o *outbox) add(msg *chat.Message) error {
+	if !buffered(msg) {
+		return nil
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if _, ok := o.unacked[msg.Envelope.Id]; !ok && len(o.unacked) >= maxUnacked {
+		log.Println("outbox full", "drop", msg.Envelope.Id)
+		return errOutboxFull
+	}
+	if err := o.db.Put([]byte(msg.Envelope.Id), msg.Bytes()); err != nil {
+		return err
+	}
+	o.unacked[msg.Envelope.Id] = struct{}{}
+	return nil
+}
+
+// 返回的函数用来注销连接
+func (o *outbox) attach(c *wsClient) func() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	id := o.nextId
+	o.nextId++
+	o.clients[id] = c
+	return func() {
+		o.lock.Lock()
+		defer o.lock.Unlock()
+		delete(o.clients, id)
+	}
+}
+
+// 节点收到消息时调用：先保存再推给已经连接的客户端，没有连接时留到下次 open 重发
+func (o *outbox) receive(msg *chat.Message) {
+	err := o.add(msg)
+	o.lock.Lock()
+	clients := make([]*wsClient, 0, len(o.clients))
+	for _, c := range o.clients {
+		clients = append(clients, c)
+	}
+	o.lock.Unlock()
+	for _, c := range clients {
+		c.write(msg)
+		if err != nil {
+			c.write(chat.NewSysMessage("",
+				chat.Attr{Key: chat.SYNC_EVENT_ATTR, Val: OUTBOX_DROP_EVENT},
+				chat.Attr{Key: chat.SYNC_MSGID_ATTR, Val: msg.Envelope.Id},
+				chat.Attr{Key: "error", Val: err.Error()}))
+		} else if !c.ack {
+			o.ack([]string{msg.Envelope.Id})
+		}
+	}
+}
+
+// 按时间顺序返回需要重发的在线消息
+func (o *outbox) pending() chat.MessageList {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	ml := make(chat.MessageList, 0, len(o.unacked))
+	it := o.db.NewIterator()
+	defer it.Release()
+	for it.Next() {
+		msg := new(chat.Message)
+		if _, err := msg.FromBytes(it.Value()); err != nil {
+			log.Println("outbox decode error", "id", string(it.Key()), "err", err)
+			continue
+		}
+		ml = append(ml, msg)
+	}
+	sort.Stable(ml)
+	return ml
+}
+
+// 返回需要从 mailbox 中清理的 id
+func (o *outbox) ack(ids []string) []string {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	clean := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := o.mailbox[id]; ok {
+			delete(o.mailbox, id)
+			clean = append(clean, id)
+		}
+		if _, ok := o.unacked[id]; ok {
+			delete(o.unacked, id)
+			o.db.Delete([]byte(id))
+		}
+	}
+	return clean
+}
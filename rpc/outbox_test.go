@@ -0,0 +1,87 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package rpc
+
+import (
+	chat "github.com/cc14514/go-achat-node"
+	"testing"
+)
+
+func TestOutbox(t *testing.T) {
+	dir := t.TempDir()
+	o := newOutbox(dir)
+	m1 := chat.NewNormalMessage("a", "b", "1")
+	m2 := chat.NewNormalMessage("a", "b", "2")
+	m2.Envelope.Ct = m1.Envelope.Ct + 1
+	o.add(m2)
+	o.add(m1)
+	o.add(chat.NewSysMessage("", chat.Attr{Key: "k", Val: "v"}))
+	o.addMailbox("x")
+	o.addMailbox("y")
+
+	if ml := o.pending(); len(ml) != 2 || ml[0].Envelope.Id != m1.Envelope.Id || ml[1].Envelope.Id != m2.Envelope.Id {
+		t.Fatal("bad pending", ml)
+	}
+	clean := o.ack([]string{"x", m1.Envelope.Id, "z"})
+	if len(clean) != 1 || clean[0] != "x" {
+		t.Fatal("only acked mailbox ids can be cleaned", clean)
+	}
+	if ml := o.pending(); len(ml) != 1 || ml[0].Envelope.Id != m2.Envelope.Id {
+		t.Fatal("acked message must not be redelivered", ml)
+	}
+	if clean = o.ack([]string{"x"}); len(clean) != 0 {
+		t.Fatal("id must be cleaned once", clean)
+	}
+
+	// 重启以后没有确认的消息还在
+	o.db.Close()
+	o = newOutbox(dir)
+	if ml := o.pending(); len(ml) != 1 || ml[0].Envelope.Id != m2.Envelope.Id {
+		t.Fatal("unacked message must survive restart", ml)
+	}
+	o.db.Close()
+}
+
+func TestOutboxReceive(t *testing.T) {
+	o := newOutbox(t.TempDir())
+	defer o.db.Close()
+	// 没有连接时收到的消息留到下次 open
+	m1 := chat.NewNormalMessage("a", "b", "1")
+	o.receive(m1)
+	if ml := o.pending(); len(ml) != 1 || ml[0].Envelope.Id != m1.Envelope.Id {
+		t.Fatal("message received while disconnected must be buffered", ml)
+	}
+
+	var acking, legacy []string
+	detach := o.attach(&wsClient{ack: true, write: func(m *chat.Message) { acking = append(acking, m.Envelope.Id) }})
+	m2 := chat.NewNormalMessage("a", "b", "2")
+	o.receive(m2)
+	if len(acking) != 1 || len(o.pending()) != 2 {
+		t.Fatal("acking client keeps the message until ack", acking, o.pending())
+	}
+	detach()
+
+	defer o.attach(&wsClient{write: func(m *chat.Message) { legacy = append(legacy, m.Envelope.Id) }})()
+	m3 := chat.NewNormalMessage("a", "b", "3")
+	o.receive(m3)
+	if len(acking) != 1 || len(legacy) != 1 || legacy[0] != m3.Envelope.Id {
+		t.Fatal("bad delivery", acking, legacy)
+	}
+	if len(o.pending()) != 2 {
+		t.Fatal("legacy client acks on write", o.pending())
+	}
+}
+
+func TestOutboxFull(t *testing.T) {
+	o := newOutbox(t.TempDir())
+	defer o.db.Close()
+	for i := 0; i < maxUnacked; i++ {
+		if err := o.add(chat.NewNormalMessage("a", "b", "x")); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+	if err := o.add(chat.NewNormalMessage("a", "b", "x")); err != errOutboxFull {
+		t.Fatal("full outbox must report the drop", err)
+	}
+}
@@ -0,0 +1,83 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package rpc
+
+import (
+	"fmt"
+	chat "github.com/cc14514/go-achat-node"
+	"strings"
+)
+
+type PubsubService struct {
+	chatservice *chat.ChatService
+}
+
+func NewPubsubService(chatservice *chat.ChatService) Service {
+	return &PubsubService{chatservice: chatservice}
+}
+
+// params = [topic]
+func (p *PubsubService) Subscribe(req *Req) *Rsp {
+	fmt.Println("pubsub.subscribe -->", req)
+	if len(req.Params) < 1 {
+		return NewRsp(req.Id, nil, &RspError{Code: "10000", Message: "topic not nil"})
+	}
+	topic, _ := req.Params[0].(string)
+	if err := p.chatservice.Subscribe(topic); err != nil {
+		return NewRsp(req.Id, nil, &RspError{Code: "10001", Message: err.Error()})
+	}
+	rsp := NewRsp(req.Id, "success", nil)
+	fmt.Println("pubsub.subscribe <--", rsp)
+	return rsp
+}
+
+// params = [topic]
+func (p *PubsubService) Unsubscribe(req *Req) *Rsp {
+	fmt.Println("pubsub.unsubscribe -->", req)
+	if len(req.Params) < 1 {
+		return NewRsp(req.Id, nil, &RspError{Code: "20000", Message: "topic not nil"})
+	}
+	topic, _ := req.Params[0].(string)
+	if err := p.chatservice.Unsubscribe(topic); err != nil {
+		return NewRsp(req.Id, nil, &RspError{Code: "20001", Message: err.Error()})
+	}
+	rsp := NewRsp(req.Id, "success", nil)
+	fmt.Println("pubsub.unsubscribe <--", rsp)
+	return rsp
+}
+
+// params = [topic, content]
+func (p *PubsubService) Publish(req *Req) *Rsp {
+	fmt.Println("pubsub.publish -->", req)
+	if len(req.Params) < 2 {
+		return NewRsp(req.Id, nil, &RspError{Code: "30000", Message: "topic / content not nil"})
+	}
+	args, err := X2Str(req.Params)
+	if err != nil {
+		return NewRsp(req.Id, nil, &RspError{Code: "30001", Message: err.Error()})
+	}
+	msg, err := p.chatservice.Publish(args[0], strings.Join(args[1:], " "))
+	if err != nil {
+		return NewRsp(req.Id, nil, &RspError{Code: "30002", Message: err.Error()})
+	}
+	rsp := NewRsp(req.Id, msg.Envelope.Id, nil)
+	fmt.Println("pubsub.publish <--", rsp)
+	return rsp
+}
+
+func (p *PubsubService) Topics(req *Req) *Rsp {
+	return NewRsp(req.Id, p.chatservice.Topics(), nil)
+}
+
+func (p *PubsubService) APIs() *API {
+	return &API{
+		Namespace: "pubsub",
+		Api: map[string]RpcFn{
+			"subscribe":   p.Subscribe,
+			"unsubscribe": p.Unsubscribe,
+			"publish":     p.Publish,
+			"topics":      p.Topics,
+		},
+	}
+}
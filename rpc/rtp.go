@@ -0,0 +1,69 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package rpc
+
+import (
+	"fmt"
+	chat "github.com/cc14514/go-achat-node"
+	"strings"
+)
+
+type RtpService struct {
+	chatservice *chat.ChatService
+}
+
+func NewRtpService(chatservice *chat.ChatService) Service {
+	return &RtpService{chatservice: chatservice}
+}
+
+// params = [jid, sdp]
+func (r *RtpService) Dial(req *Req) *Rsp {
+	fmt.Println("rtp.dial -->", req)
+	p, err := X2Str(req.Params)
+	if err != nil || len(p) < 1 {
+		return NewRsp(req.Id, nil, &RspError{Code: "10000", Message: "jid not nil"})
+	}
+	call, err := r.chatservice.Dial(chat.JID(p[0]), strings.Join(p[1:], " "))
+	if err != nil {
+		return NewRsp(req.Id, nil, &RspError{Code: "10001", Message: err.Error()})
+	}
+	rsp := NewRsp(req.Id, call, nil)
+	fmt.Println("rtp.dial <--", rsp)
+	return rsp
+}
+
+// answer / candidate / hangup / reject 的参数都是 [callid, content]
+func (r *RtpService) signal(name string, fn func(callid, content string) error) RpcFn {
+	return func(req *Req) *Rsp {
+		fmt.Printf("rtp.%s --> %v\n", name, req)
+		p, err := X2Str(req.Params)
+		if err != nil || len(p) < 1 {
+			return NewRsp(req.Id, nil, &RspError{Code: "20000", Message: "callid not nil"})
+		}
+		if err = fn(p[0], strings.Join(p[1:], " ")); err != nil {
+			return NewRsp(req.Id, nil, &RspError{Code: "20001", Message: err.Error()})
+		}
+		rsp := NewRsp(req.Id, "success", nil)
+		fmt.Printf("rtp.%s <-- %v\n", name, rsp)
+		return rsp
+	}
+}
+
+func (r *RtpService) Calls(req *Req) *Rsp {
+	return NewRsp(req.Id, r.chatservice.Calls(), nil)
+}
+
+func (r *RtpService) APIs() *API {
+	return &API{
+		Namespace: "rtp",
+		Api: map[string]RpcFn{
+			"dial":      r.Dial,
+			"answer":    r.signal("answer", r.chatservice.Answer),
+			"candidate": r.signal("candidate", r.chatservice.Candidate),
+			"hangup":    r.signal("hangup", func(callid, _ string) error { return r.chatservice.Hangup(callid) }),
+			"reject":    r.signal("reject", func(callid, _ string) error { return r.chatservice.Reject(callid) }),
+			"calls":     r.Calls,
+		},
+	}
+}
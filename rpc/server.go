@@ -14,6 +14,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path"
 	"strings"
 	"time"
 )
@@ -23,6 +24,7 @@ var (
 	pwd         string
 	rpcport     int
 	tokenmap    = make(map[string]int64)
+	box         *outbox
 	servicemap  = make(map[string]Service)
 	serviceReg  = func(s Service) {
 		servicemap[s.APIs().Namespace] = s
@@ -67,23 +69,44 @@ var (
 			}
 		},
 
-		"sendmsg": func(req *Req) *Rsp {
-			to := req.Params[0]
-			c, err := X2Str(req.Params[1:])
-			if err != nil {
-				return NewRsp(req.Id, nil, &RspError{Code: "1003", Message: err.Error()})
+		"sendmsg": func(req *Req) *Rsp { return sendmsg(req, false) },
+
+		// 与 sendmsg 相同，但要求对方回执，返回消息的 id ，回执中的 msgid 就是这个值
+		"sendmsgack": func(req *Req) *Rsp { return sendmsg(req, true) },
+
+		// params = [jid, msgid, ...] , 告诉 jid 这些消息已读
+		"readmsg": func(req *Req) *Rsp {
+			p, err := X2Str(req.Params)
+			if err != nil || len(p) < 2 {
+				return NewRsp(req.Id, nil, &RspError{Code: "1003", Message: "jid / msgid not nil"})
 			}
-			content := strings.Join(c, " ")
-			msg := chat.NewNormalMessage(chatservice.GetMyid(), chat.JID(to.(string)), content)
-			if err := chatservice.SendMsg(msg); err != nil {
+			if err := chatservice.SendReceipt(chat.JID(p[0]), chat.SYNC_READ, p[1:]...); err != nil {
 				return NewRsp(req.Id, nil, &RspError{Code: "1003", Message: err.Error()})
-			} else {
-				return NewRsp(req.Id, "success", nil)
 			}
+			return NewRsp(req.Id, "success", nil)
 		},
 
 		"myid": func(req *Req) *Rsp { return NewRsp(req.Id, chatservice.GetMyid(), nil) },
 
+		// params = [peerid] ，查询对方支持的协议和功能，不传时返回自己的
+		"caps": func(req *Req) *Rsp {
+			p, err := X2Str(req.Params)
+			if err != nil {
+				return NewRsp(req.Id, nil, &RspError{Code: "1003", Message: err.Error()})
+			}
+			var peerid string
+			if len(p) > 0 {
+				if peerid = chat.JID(p[0]).Peerid(); peerid == "" {
+					return NewRsp(req.Id, nil, &RspError{Code: "1003", Message: "bad peerid"})
+				}
+			}
+			caps, err := chatservice.Caps(peerid)
+			if err != nil {
+				return NewRsp(req.Id, nil, &RspError{Code: "1003", Message: err.Error()})
+			}
+			return NewRsp(req.Id, caps, nil)
+		},
+
 		"conns": func(req *Req) *Rsp {
 			p2pservice := chatservice.GetLibp2pService()
 			s := time.Now()
@@ -138,36 +161,93 @@ var (
 func startService() {
 	serviceReg(NewUserService(chatservice))
 	serviceReg(NewGroupService(chatservice))
+	serviceReg(NewPubsubService(chatservice))
+	serviceReg(NewRtpService(chatservice))
+	serviceReg(NewHistoryService(chatservice))
+	serviceReg(NewBlobService(chatservice))
+
+}
+
+// params = [jid, content, ...]
+func sendmsg(req *Req, ack bool) *Rsp {
+	if len(req.Params) < 2 {
+		return NewRsp(req.Id, nil, &RspError{Code: "1003", Message: "jid / content not nil"})
+	}
+	p, err := X2Str(req.Params)
+	if err != nil {
+		return NewRsp(req.Id, nil, &RspError{Code: "1003", Message: err.Error()})
+	}
+	msg := chat.NewNormalMessage(chatservice.GetMyid(), chat.JID(p[0]), strings.Join(p[1:], " "))
+	if ack {
+		msg.Envelope.Ack = chat.ACK
+	}
+	if err := chatservice.SendMsg(msg); err != nil {
+		return NewRsp(req.Id, nil, &RspError{Code: "1003", Message: err.Error()})
+	}
+	if ack {
+		return NewRsp(req.Id, msg.Envelope.Id, nil)
+	}
+	return NewRsp(req.Id, "success", nil)
+}
 
+func lookupFn(method string) RpcFn {
+	if fn, ok := fnReg[method]; ok {
+		return fn
+	}
+	return getRpcFn(method)
+}
+
+// 校验 token 并调用接口，旧格式和 JSON-RPC 2.0 共用
+func call(req *Req) *Rsp {
+	if req.Method != "auth" && tokenmap[req.Token] <= 0 {
+		return NewRsp(req.Id, nil, &RspError{
+			Code:    "1001",
+			Message: "error token , please relogin .",
+		})
+	}
+	if fn := lookupFn(req.Method); fn != nil {
+		return fn(req)
+	}
+	return NewRsp(req.Id, nil, &RspError{
+		Code:    "1003",
+		Message: "method_not_support",
+	})
+}
+
+func wantAck(params []interface{}) bool {
+	for _, p := range params {
+		if s, ok := p.(string); ok && s == "ack" {
+			return true
+		}
+	}
+	return false
 }
 
 func StartRPC(_pwd string, _rpcport int, _chatservice *chat.ChatService) {
 	chatservice, pwd, rpcport = _chatservice, _pwd, _rpcport
+	box = newOutbox(path.Join(chatservice.GetHomedir(), "rpc_outbox"))
+	// 没有 websocket 连接时收到的消息也要保存，下次 open 时重发
+	chatservice.AppendHandleMsg(func(service *chat.ChatService, msg *chat.Message) {
+		box.receive(msg)
+	})
 	http.HandleFunc("/rpc", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*") //允许访问所有域
 		w.Header().Set("content-type", "application/json") //返回数据格式是json
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		if r.Method == http.MethodOptions {
+			return
+		}
 
 		data, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			log.Println("ws_error", "err", err)
 			return
 		}
-		req := new(Req).FromBytes(data)
-		if req.Method != "auth" && tokenmap[req.Token] <= 0 {
-			NewRsp(req.Id, nil, &RspError{
-				Code:    "1001",
-				Message: "error token , please relogin .",
-			}).WriteTo(w)
-		} else if fn, ok := fnReg[req.Method]; ok {
-			fn(req).WriteTo(w)
-		} else if _fn := getRpcFn(req.Method); _fn != nil {
-			_fn(req).WriteTo(w)
-		} else {
-			NewRsp(req.Id, nil, &RspError{
-				Code:    "1003",
-				Message: "method_not_support",
-			}).WriteTo(w)
+		if isJsonrpc(data) {
+			serveJsonrpc(w, bearerToken(r), data)
+			return
 		}
+		call(new(Req).FromBytes(data)).WriteTo(w)
 	})
 
 	http.Handle("/chat", websocket.Handler(func(ws *websocket.Conn) {
@@ -190,23 +270,53 @@ func StartRPC(_pwd string, _rpcport int, _chatservice *chat.ChatService) {
 		ws.Write(chat.NewSysMessage("",
 			chat.Attr{Key: "method", Val: req.Method},
 			chat.Attr{Key: "result", Val: "success"}).Json())
+		// params = ["ack"] 时客户端会确认，否则写出即视为确认
+		client := &wsClient{ack: wantAck(req.Params)}
+		client.write = func(m *chat.Message) { ws.Write(m.Json()) }
+		// 先注册连接再重发，避免漏掉这期间收到的消息；客户端需要按 id 去重
+		detach := box.attach(client)
+		defer detach()
+		ids := make([]string, 0)
+		for _, m := range box.pending() {
+			ids = append(ids, m.Envelope.Id)
+			client.write(m)
+		}
+		if !client.ack {
+			box.ack(ids)
+		}
+		// 离线消息要等客户端 ack 以后才从 mailbox 清理
 		if ml, err := chatservice.QueryMsg(); err == nil {
-			ids := make([]string, 0)
+			ids = ids[:0]
 			for _, m := range ml.Messages {
 				ids = append(ids, m.Envelope.Id)
-				ws.Write(m.Json())
+				if client.ack {
+					box.addMailbox(m.Envelope.Id)
+				}
+				client.write(m)
+			}
+			if !client.ack {
+				chatservice.CleanMsg(ids)
 			}
-			chatservice.CleanMsg(ids)
 		}
-		fid := chatservice.AppendHandleMsg(func(service *chat.ChatService, msg *chat.Message) {
-			ws.Write(msg.Json())
-		})
-		defer chatservice.DropHandleMsg(fid)
 		for {
 			if err = websocket.Message.Receive(ws, &in); err != nil {
 				return
 			}
 			log.Println("==ws==>", in)
+			req := new(Req).FromBytes([]byte(in))
+			if req.Method != "ack" {
+				continue
+			}
+			// params = [msgid, ...]
+			ids, err := X2Str(req.Params)
+			if err == nil {
+				err = chatservice.CleanMsg(box.ack(ids))
+			}
+			rtn := chat.Attr{Key: "result", Val: "success"}
+			if err != nil {
+				rtn = chat.Attr{Key: "error", Val: err.Error()}
+			}
+			ws.Write(chat.NewSysMessage(req.Id, chat.Attr{Key: "method", Val: req.Method}, rtn).Json())
 		}
 	}))
 	startService()
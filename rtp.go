@@ -0,0 +1,322 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"github.com/cc14514/go-alibp2p"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+RTP 拨号信令，只负责信令，媒体不经过节点：
+主叫 offer -> 被叫 answer / busy，双方在通话前后都可以交换 candidate（地址），任何一方都可以 hangup；
+信令是 RtpMsg ，signal 和 callid 放在 Payload.Attrs 中，sdp / 地址放在 Payload.Content 中，
+只走 PID_RTP 直连，不会存 mailbox 。
+
+状态机：
+	主叫   -- offer -->  dialing  -- answer -->  active
+	被叫   -- offer -->  ringing  -- answer -->  active
+	dialing / ringing 超过 ringTimeout 没有 answer 就挂断
+	dialing / ringing / active -- hangup --> ended
+	dialing (收到) / ringing (发出) -- busy --> ended
+	正在通话时收到 offer ，直接在响应中返回 RSP_BUSY ，主叫的 Dial 返回 errCallBusy
+*/
+
+const (
+	RTP_SIGNAL_ATTR = "rtp"
+	RTP_CALLID_ATTR = "callid"
+	RTP_STATE_ATTR  = "state"
+
+	RTP_OFFER     = "offer"
+	RTP_ANSWER    = "answer"
+	RTP_CANDIDATE = "candidate"
+	RTP_HANGUP    = "hangup"
+	RTP_BUSY      = "busy"
+	RTP_TIMEOUT   = "timeout" // 只在本地产生，不会发给对方
+)
+
+const (
+	CALL_DIALING CallState = "dialing"
+	CALL_RINGING CallState = "ringing"
+	CALL_ACTIVE  CallState = "active"
+	CALL_ENDED   CallState = "ended"
+)
+
+var (
+	ringTimeout   = 30 * time.Second
+	errCallBusy   = errors.New("busy")
+	errNoCall     = errors.New("call not found")
+	errBadSignal  = errors.New("bad signal")
+	errBadCallMsg = errors.New("bad rtp message")
+)
+
+type (
+	CallState string
+
+	Call struct {
+		Id       string    `json:"id"`
+		Peer     JID       `json:"peer"`
+		State    CallState `json:"state"`
+		Outgoing bool      `json:"outgoing"`
+		Ct       int64     `json:"ct"`
+		timer    *time.Timer
+	}
+
+	rtpService struct {
+		lock    sync.Mutex
+		calls   map[string]*Call
+		c       *ChatService
+		sendMsg func(*Message) error
+	}
+)
+
+// local 为 true 表示信令由本节点发出
+func callTransition(state CallState, signal string, local bool) (CallState, error) {
+	switch signal {
+	case RTP_ANSWER:
+		if (local && state == CALL_RINGING) || (!local && state == CALL_DIALING) {
+			return CALL_ACTIVE, nil
+		}
+	case RTP_CANDIDATE:
+		if state == CALL_DIALING || state == CALL_RINGING || state == CALL_ACTIVE {
+			return state, nil
+		}
+	case RTP_HANGUP:
+		if state == CALL_DIALING || state == CALL_RINGING || state == CALL_ACTIVE {
+			return CALL_ENDED, nil
+		}
+	case RTP_BUSY:
+		if (local && state == CALL_RINGING) || (!local && state == CALL_DIALING) {
+			return CALL_ENDED, nil
+		}
+	}
+	return state, fmt.Errorf("%w : %s on %s", errBadSignal, signal, state)
+}
+
+func NewRtpMessage(from, to JID, callid, signal, content string) *Message {
+	return newMessage(from, to, "", content, RtpMsg,
+		Attr{Key: RTP_SIGNAL_ATTR, Val: signal},
+		Attr{Key: RTP_CALLID_ATTR, Val: callid})
+}
+
+func newRtpService(c *ChatService) *rtpService {
+	r := &rtpService{calls: make(map[string]*Call), c: c}
+	if c != nil {
+		r.sendMsg = c.SendMsg
+	}
+	return r
+}
+
+func (r *rtpService) list() []*Call {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	calls := make([]*Call, 0, len(r.calls))
+	for _, call := range r.calls {
+		cpy := *call
+		calls = append(calls, &cpy)
+	}
+	sort.Slice(calls, func(i, j int) bool { return calls[i].Ct < calls[j].Ct })
+	return calls
+}
+
+// 同一时间只允许一个通话
+func (r *rtpService) busy() bool {
+	return len(r.calls) > 0
+}
+
+func (r *rtpService) newCall(id string, peer JID, outgoing bool) *Call {
+	call := &Call{Id: id, Peer: peer, State: CALL_RINGING, Outgoing: outgoing, Ct: time.Now().Unix()}
+	if outgoing {
+		call.State = CALL_DIALING
+	}
+	call.timer = time.AfterFunc(ringTimeout, func() { r.timeout(id) })
+	r.calls[id] = call
+	return call
+}
+
+// 改变状态，结束的通话直接删掉；调用时需要持有锁
+func (r *rtpService) setState(call *Call, state CallState) {
+	call.State = state
+	if state != CALL_DIALING && state != CALL_RINGING {
+		call.timer.Stop()
+	}
+	if state == CALL_ENDED {
+		delete(r.calls, call.Id)
+	}
+}
+
+func (r *rtpService) timeout(id string) {
+	r.lock.Lock()
+	call, ok := r.calls[id]
+	if !ok || (call.State != CALL_DIALING && call.State != CALL_RINGING) {
+		r.lock.Unlock()
+		return
+	}
+	r.setState(call, CALL_ENDED)
+	r.lock.Unlock()
+	log.Println("rtp timeout", "callid", id, "peer", call.Peer)
+	go r.send(call.Peer, id, RTP_HANGUP, "")
+	event := NewRtpMessage("", r.c.myid, id, RTP_TIMEOUT, "")
+	event.Payload.SetAttr(RTP_STATE_ATTR, string(CALL_ENDED))
+	r.c.deliver(event)
+}
+
+func (r *rtpService) send(to JID, callid, signal, content string) error {
+	msg := NewRtpMessage(r.c.myid, to, callid, signal, content)
+	return r.sendMsg(msg)
+}
+
+func (r *rtpService) dial(to JID, sdp string) (*Call, error) {
+	r.lock.Lock()
+	if r.busy() {
+		r.lock.Unlock()
+		return nil, errCallBusy
+	}
+	msg := NewRtpMessage(r.c.myid, to, "", RTP_OFFER, sdp)
+	msg.Payload.SetAttr(RTP_CALLID_ATTR, msg.Envelope.Id)
+	call := r.newCall(msg.Envelope.Id, to, true)
+	cpy := *call
+	r.lock.Unlock()
+	if err := r.sendMsg(msg); err != nil {
+		r.lock.Lock()
+		r.setState(call, CALL_ENDED)
+		r.lock.Unlock()
+		// 对方忙线时返回 errCallBusy
+		if errors.Is(err, errCallBusy) {
+			return nil, errCallBusy
+		}
+		return nil, err
+	}
+	return &cpy, nil
+}
+
+// 本地发出 answer / candidate / hangup / busy
+func (r *rtpService) signal(callid, signal, content string) error {
+	r.lock.Lock()
+	call, ok := r.calls[callid]
+	if !ok {
+		r.lock.Unlock()
+		return errNoCall
+	}
+	prev := call.State
+	state, err := callTransition(prev, signal, true)
+	if err != nil {
+		r.lock.Unlock()
+		return err
+	}
+	r.lock.Unlock()
+	// 发送成功以后才改变状态；hangup / busy 发送失败时本地也结束，对方会超时挂断
+	err = r.send(call.Peer, callid, signal, content)
+	if err != nil && state != CALL_ENDED {
+		return err
+	}
+	r.lock.Lock()
+	if cur, ok := r.calls[callid]; ok && cur.State == prev {
+		r.setState(cur, state)
+	}
+	r.lock.Unlock()
+	return err
+}
+
+// 处理收到的信令，返回需要推给 handler 的事件
+func (r *rtpService) handle(msg *Message) (*Message, error) {
+	signal, _ := msg.Payload.GetAttr(RTP_SIGNAL_ATTR)
+	callid, _ := msg.Payload.GetAttr(RTP_CALLID_ATTR)
+	if signal == "" || callid == "" {
+		return nil, errBadCallMsg
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var state CallState
+	if signal == RTP_OFFER {
+		if _, ok := r.calls[callid]; ok {
+			return nil, errBadSignal
+		}
+		// 忙线时直接在响应中返回 busy
+		if r.busy() {
+			return nil, errCallBusy
+		}
+		state = r.newCall(callid, msg.Envelope.From, false).State
+	} else {
+		call, ok := r.calls[callid]
+		if !ok {
+			return nil, errNoCall
+		}
+		if call.Peer.Peerid() != msg.Envelope.From.Peerid() {
+			return nil, errPermissionDenied
+		}
+		var err error
+		if state, err = callTransition(call.State, signal, false); err != nil {
+			return nil, err
+		}
+		r.setState(call, state)
+	}
+	msg.Payload.SetAttr(RTP_STATE_ATTR, string(state))
+	return msg, nil
+}
+
+func (c *ChatService) rtpHandler() {
+	c.p2pservice.SetHandler(PID_RTP, func(sessionId string, pubkey *ecdsa.PublicKey, rw io.ReadWriter) error {
+		msg, err := new(Message).FromReader(rw)
+		if err != nil {
+			writeRsp(rw, RSP_BAD_REQUEST, err)
+			return err
+		}
+		var (
+			message = msg.(*Message)
+			code    = RSP_BAD_REQUEST
+		)
+		from, _ := alibp2p.ECDSAPubEncode(pubkey)
+		if message.Envelope.Type != RtpMsg {
+			err = errBadCallMsg
+		} else if message.Envelope.From.Peerid() != from {
+			code, err = RSP_FORBIDDEN, errBadCallMsg
+		} else if err = message.Verify(); err != nil {
+			code = RSP_UNAUTHORIZED
+		} else if message, err = c.rtp.handle(message); errors.Is(err, errCallBusy) {
+			code = RSP_BUSY
+		}
+		if err != nil {
+			log.Println("PID_RTP error", "session", sessionId, "from", from, "err", err)
+			writeRsp(rw, code, err)
+			return err
+		}
+		c.deliver(message)
+		return writeRsp(rw, RSP_OK, nil)
+	})
+}
+
+// 呼叫 to ，sdp 为本地的媒体描述，返回的 Call.Id 用于后续的信令
+func (c *ChatService) Dial(to JID, sdp string) (*Call, error) {
+	return c.rtp.dial(to, sdp)
+}
+
+func (c *ChatService) Answer(callid, sdp string) error {
+	return c.rtp.signal(callid, RTP_ANSWER, sdp)
+}
+
+// 交换地址，通话建立前后都可以发送
+func (c *ChatService) Candidate(callid, addr string) error {
+	return c.rtp.signal(callid, RTP_CANDIDATE, addr)
+}
+
+func (c *ChatService) Hangup(callid string) error {
+	return c.rtp.signal(callid, RTP_HANGUP, "")
+}
+
+// 拒接
+func (c *ChatService) Reject(callid string) error {
+	return c.rtp.signal(callid, RTP_BUSY, "")
+}
+
+func (c *ChatService) Calls() []*Call {
+	return c.rtp.list()
+}
@@ -0,0 +1,116 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCallTransition(t *testing.T) {
+	for i, c := range []struct {
+		state  CallState
+		signal string
+		local  bool
+		want   CallState
+		ok     bool
+	}{
+		{CALL_DIALING, RTP_ANSWER, false, CALL_ACTIVE, true},
+		{CALL_RINGING, RTP_ANSWER, true, CALL_ACTIVE, true},
+		{CALL_DIALING, RTP_ANSWER, true, CALL_DIALING, false},
+		{CALL_RINGING, RTP_ANSWER, false, CALL_RINGING, false},
+		{CALL_ACTIVE, RTP_CANDIDATE, false, CALL_ACTIVE, true},
+		{CALL_ACTIVE, RTP_HANGUP, true, CALL_ENDED, true},
+		{CALL_RINGING, RTP_BUSY, true, CALL_ENDED, true},
+		{CALL_DIALING, RTP_BUSY, false, CALL_ENDED, true},
+		{CALL_ACTIVE, RTP_BUSY, false, CALL_ACTIVE, false},
+		{CALL_ENDED, RTP_HANGUP, false, CALL_ENDED, false},
+		{CALL_ACTIVE, RTP_OFFER, false, CALL_ACTIVE, false},
+	} {
+		state, err := callTransition(c.state, c.signal, c.local)
+		if state != c.want || (err == nil) != c.ok {
+			t.Fatal(i, "want", c.want, c.ok, "got", state, err)
+		}
+	}
+}
+
+func TestRtpHandle(t *testing.T) {
+	r := newRtpService(nil)
+	offer := NewRtpMessage(testMember1, testOwner, "call1", RTP_OFFER, "sdp")
+	event, err := r.handle(offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := event.Payload.GetAttr(RTP_STATE_ATTR); state != string(CALL_RINGING) {
+		t.Fatal("bad state", state)
+	}
+	if _, err = r.handle(NewRtpMessage(testMember2, testOwner, "call2", RTP_OFFER, "sdp")); err != errCallBusy {
+		t.Fatal("want busy", err)
+	}
+	if _, err = r.handle(NewRtpMessage(testMember2, testOwner, "call1", RTP_HANGUP, "")); err != errPermissionDenied {
+		t.Fatal("want permission denied", err)
+	}
+	// 被叫还没有 answer ，收到对方的 answer 是非法的
+	if _, err = r.handle(NewRtpMessage(testMember1, testOwner, "call1", RTP_ANSWER, "")); !errors.Is(err, errBadSignal) {
+		t.Fatal("want bad signal", err)
+	}
+	if _, err = r.handle(NewRtpMessage(testMember1, testOwner, "call1", RTP_CANDIDATE, "addr")); err != nil {
+		t.Fatal(err)
+	}
+	event, err = r.handle(NewRtpMessage(testMember1, testOwner, "call1", RTP_HANGUP, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := event.Payload.GetAttr(RTP_STATE_ATTR); state != string(CALL_ENDED) {
+		t.Fatal("bad state", state)
+	}
+	if len(r.list()) != 0 {
+		t.Fatal("ended call must be removed", r.list())
+	}
+	if _, err = r.handle(NewRtpMessage(testMember1, testOwner, "call1", RTP_HANGUP, "")); err != errNoCall {
+		t.Fatal("want no call", err)
+	}
+}
+
+func TestRtpSignalFailed(t *testing.T) {
+	var (
+		r    = newRtpService(&ChatService{myid: testOwner})
+		fail = errors.New("network")
+		busy = newResponse(RSP_BUSY, errCallBusy).Err()
+	)
+	r.sendMsg = func(*Message) error { return busy }
+	if _, err := r.dial(testMember1, "sdp"); err != errCallBusy {
+		t.Fatal("callee busy must map to errCallBusy", err)
+	}
+	if len(r.list()) != 0 {
+		t.Fatal("busy call must be ended", r.list())
+	}
+
+	if _, err := r.handle(NewRtpMessage(testMember1, testOwner, "call1", RTP_OFFER, "sdp")); err != nil {
+		t.Fatal(err)
+	}
+	// answer 没有发出去时保持 ringing
+	r.sendMsg = func(*Message) error { return fail }
+	if err := r.signal("call1", RTP_ANSWER, "sdp"); err != fail {
+		t.Fatal(err)
+	}
+	if calls := r.list(); len(calls) != 1 || calls[0].State != CALL_RINGING {
+		t.Fatal("failed answer must not change state", calls)
+	}
+	r.sendMsg = func(*Message) error { return nil }
+	if err := r.signal("call1", RTP_ANSWER, "sdp"); err != nil {
+		t.Fatal(err)
+	}
+	if calls := r.list(); len(calls) != 1 || calls[0].State != CALL_ACTIVE {
+		t.Fatal("bad state", calls)
+	}
+	// hangup 发送失败时本地也结束
+	r.sendMsg = func(*Message) error { return fail }
+	if err := r.signal("call1", RTP_HANGUP, ""); err != fail {
+		t.Fatal(err)
+	}
+	if len(r.list()) != 0 {
+		t.Fatal("hangup must end the call locally", r.list())
+	}
+}
@@ -0,0 +1,93 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/cc14514/go-achat-node/ldb"
+	"log"
+	"sync"
+)
+
+/*
+收到的消息按 Envelope.Id 去重：最近的 maxSeen 个 id 保存在 homedir/seen 中，
+key = "SEEN" + 序号(8 字节大端) ，value 为消息 id ，超出以后从最早的开始删除，启动时加载到内存
+*/
+
+const seen_prefix = "SEEN"
+
+var maxSeen = 10000
+
+type seenSet struct {
+	lock        sync.Mutex
+	db          *ldb.LDBDatabase
+	ids         map[string]uint64
+	first, next uint64
+}
+
+func seenK(seq uint64) []byte {
+	return binary.BigEndian.AppendUint64([]byte(seen_prefix), seq)
+}
+
+func newSeenSet(dir string) *seenSet {
+	db, err := ldb.NewLDBDatabase(dir, 0, 0)
+	if err != nil {
+		panic(err)
+	}
+	s := &seenSet{db: db, ids: make(map[string]uint64)}
+	prefix := []byte(seen_prefix)
+	it := db.NewIterator()
+	defer it.Release()
+	for ok := it.Seek(prefix); ok && bytes.HasPrefix(it.Key(), prefix); ok = it.Next() {
+		if len(it.Key()) != len(prefix)+8 {
+			continue
+		}
+		seq := binary.BigEndian.Uint64(it.Key()[len(prefix):])
+		if len(s.ids) == 0 {
+			s.first = seq
+		}
+		s.ids[string(it.Value())] = seq
+		s.next = seq + 1
+	}
+	return s
+}
+
+func (s *seenSet) has(id string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.ids[id]
+	return ok
+}
+
+// 记录 id ，已经存在时返回 false
+func (s *seenSet) add(id string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.ids[id]; ok {
+		return false
+	}
+	if err := s.db.Put(seenK(s.next), []byte(id)); err != nil {
+		log.Println("seen put error", "id", id, "err", err)
+	}
+	s.ids[id] = s.next
+	s.next++
+	for len(s.ids) > maxSeen && s.first < s.next {
+		k := seenK(s.first)
+		if old, err := s.db.Get(k); err == nil && s.ids[string(old)] == s.first {
+			delete(s.ids, string(old))
+		}
+		s.db.Delete(k)
+		s.first++
+	}
+	return true
+}
+
+// 本地产生的事件（没有 from）不需要去重
+func (c *ChatService) firstSeen(msg *Message) bool {
+	if msg.Envelope.From == "" {
+		return true
+	}
+	return c.seen.add(msg.Envelope.Id)
+}
@@ -0,0 +1,35 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2026 liangchuan
+
+package chat
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSeenSet(t *testing.T) {
+	defer func(n int) { maxSeen = n }(maxSeen)
+	maxSeen = 3
+	dir := t.TempDir()
+	s := newSeenSet(dir)
+	if !s.add("a") || s.add("a") || !s.has("a") {
+		t.Fatal("bad add")
+	}
+	for i := 0; i < 3; i++ {
+		s.add(fmt.Sprintf("m%d", i))
+	}
+	// 超出 maxSeen 时删除最早的
+	if s.has("a") || !s.has("m0") || len(s.ids) != maxSeen {
+		t.Fatal("bad evict", s.ids)
+	}
+	s.db.Close()
+
+	s = newSeenSet(dir)
+	if len(s.ids) != maxSeen || !s.has("m2") || s.has("a") {
+		t.Fatal("bad reload", s.ids)
+	}
+	if s.add("m1") || !s.add("m3") || s.has("m0") {
+		t.Fatal("bad add after reload", s.ids)
+	}
+}
@@ -11,6 +11,9 @@ import (
 	"github.com/google/uuid"
 	"io"
 	"log"
+	"path"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -18,19 +21,28 @@ import (
 const (
 	PID_NORMAL        = "/chat/normal/0.0.1"
 	PID_GROUP         = "/chat/group/0.0.1"
+	PID_RTP           = "/chat/rtp/0.0.1"
+	PID_CHUNK         = "/chat/chunk/0.0.1"
+	PID_BLOB          = "/chat/blob/0.0.1"
 	PID_MAILBOX       = "/chat/mailbox/put/0.0.1"
 	PID_MAILBOX_QUERY = "/chat/mailbox/query/0.0.1"
+	PID_MAILBOX_PAGE  = "/chat/mailbox/query/page/0.0.1"
 	PID_MAILBOX_CLEAN = "/chat/mailbox/clean/0.0.1"
+	PID_MAILBOX_BIND  = "/chat/mailbox/bind/0.0.1"
+	PID_MAILBOX_BLOB  = "/chat/mailbox/blob/0.0.1"
 
-	PID_MAILBOX_GROUP_UPDATE = "/chat/mailbox/group/update/0.0.1"
-	PID_MAILBOX_GROUP_DROP   = "/chat/mailbox/group/drop/0.0.1"
-	PID_MAILBOX_GROUP_MSG    = "/chat/mailbox/group/msg/0.0.1"
-	PID_MAILBOX_GROUP_MEMBER = "/chat/mailbox/group/member/0.0.1"
+	PID_MAILBOX_GROUP_UPDATE  = "/chat/mailbox/group/update/0.0.1"
+	PID_MAILBOX_GROUP_GET     = "/chat/mailbox/group/get/0.0.1"
+	PID_MAILBOX_GROUP_DROP    = "/chat/mailbox/group/drop/0.0.1"
+	PID_MAILBOX_GROUP_MSG     = "/chat/mailbox/group/msg/0.0.1"
+	PID_MAILBOX_GROUP_MEMBER  = "/chat/mailbox/group/member/0.0.1"
+	PID_MAILBOX_GROUP_HISTORY = "/chat/mailbox/group/history/0.0.1"
 )
 
 var (
-	timeout = 10 * time.Second
-	SUCCESS = []byte("success")
+	timeout   = 10 * time.Second
+	bindRetry = 30 * time.Second
+	SUCCESS   = []byte("success")
 )
 
 type ChatService struct {
@@ -43,10 +55,22 @@ type ChatService struct {
 	handleMsgFn map[string]MsgHandle
 	lock        *sync.Mutex
 	mbox        *mailbox
+	e2e         bool // 发送 NormalMsg 时是否端到端加密
+	topics      map[string]struct{}
+	rtp         *rtpService
+	history     *history
+	chunks      *chunker
+	blobs       *blobStore // 自己上传的
+	recvBlobs   *blobStore // 下载的
+	queue       *sendQueue
+	seen        *seenSet
+	acked       *seenSet // 已经回过送达回执的消息
+	caps        *capsCache
 }
 
 func NewChatService(ctx context.Context, myid JID, homedir string, p2pservice alibp2p.Libp2pService) *ChatService {
-	return &ChatService{
+	chunks := newChunker(p2pservice)
+	c := &ChatService{
 		ctx:         ctx,
 		myid:        myid,
 		homedir:     homedir,
@@ -55,8 +79,19 @@ func NewChatService(ctx context.Context, myid JID, homedir string, p2pservice al
 		stop:        make(chan struct{}),
 		handleMsgFn: make(map[string]MsgHandle),
 		lock:        new(sync.Mutex),
-		mbox:        newMailbox(ctx, homedir, myid, p2pservice),
+		topics:      make(map[string]struct{}),
+		mbox:        newMailbox(ctx, homedir, myid, p2pservice, chunks),
+		history:     newHistory(homedir),
+		chunks:      chunks,
+		blobs:       newBlobStore(path.Join(homedir, "blob")),
+		recvBlobs:   newBlobStore(path.Join(homedir, "blob_recv")),
+		queue:       newSendQueue(homedir),
+		seen:        newSeenSet(path.Join(homedir, "seen")),
+		acked:       newSeenSet(path.Join(homedir, "acked")),
+		caps:        newCapsCache(),
 	}
+	c.rtp = newRtpService(c)
+	return c
 }
 
 func (c *ChatService) GetHomedir() string {
@@ -70,6 +105,50 @@ func (c *ChatService) GetLibp2pService() alibp2p.Libp2pService {
 	return c.p2pservice
 }
 
+// 打开以后发送的 NormalMsg 都会用接收人的公钥加密，mailbox 无法读取内容
+func (c *ChatService) EnableE2E(on bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.e2e = on
+}
+
+func (c *ChatService) isE2E() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.e2e
+}
+
+// 本节点作为 mailbox 时离线消息的有效期，notify 为 true 时消息过期会通知发送人，需要在 Start 之前调用
+func (c *ChatService) SetMailboxTTL(ttl time.Duration, notify bool) {
+	if ttl > 0 {
+		c.mbox.ttl = ttl
+	}
+	c.mbox.notify = notify
+}
+
+// 本节点作为 mailbox 时是否接收没有通过 PID_MAILBOX_BIND 注册的 jid 的离线消息，
+// 旧版本客户端不会注册，升级过渡期间可以打开，需要在 Start 之前调用
+func (c *ChatService) SetMailboxOpen(open bool) {
+	c.mbox.open = open
+}
+
+// 本节点作为 mailbox 时每个接收人最多保存的条数和字节数，以及每个发送人每秒最多写入的条数，小于等于 0 表示不限制，需要在 Start 之前调用
+func (c *ChatService) SetMailboxQuota(maxCount, maxBytes int64, rate float64, burst int) {
+	c.mbox.maxCount, c.mbox.maxBytes = maxCount, maxBytes
+	c.mbox.limiter = newLimiter(rate, burst)
+}
+
+// 收到的加密消息在交给 handler 之前解密，解密失败时换成一条 SysMsg ，不把密文当明文交出去
+func (c *ChatService) openMsg(msg *Message) *Message {
+	if IsE2EMsg(msg) {
+		if err := DecryptMsg(c.p2pservice.Nodekey(), msg); err != nil {
+			log.Println("decryptMsg error", "id", msg.Envelope.Id, "from", msg.Envelope.From, "err", err)
+			return decryptFailedMsg(msg, err)
+		}
+	}
+	return msg
+}
+
 func (c *ChatService) AppendHandleMsg(fn MsgHandle) string {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -89,8 +168,21 @@ func (c *ChatService) Stop() error {
 	return nil
 }
 
+// 把消息交给 handler
+func (c *ChatService) deliver(msg *Message) {
+	select {
+	case c.recvMsgCh <- msg:
+	case <-c.stop:
+	case <-c.ctx.Done():
+	}
+}
+
 func (c *ChatService) Start() error {
+	c.chunks.start()
 	c.normalService()
+	c.rtpHandler()
+	c.blobService()
+	c.capsService()
 	go func() {
 		for {
 			select {
@@ -99,67 +191,391 @@ func (c *ChatService) Start() error {
 			case <-c.stop:
 				return
 			case msg := <-c.recvMsgCh:
+				// 直连超时但实际已送达时，发送人还会写 mailbox ，同一条消息可能收到多次
+				if !c.firstSeen(msg.(*Message)) {
+					log.Println("drop duplicate msg", "id", msg.(*Message).Envelope.Id, "from", msg.(*Message).Envelope.From)
+					continue
+				}
+				message := c.openMsg(msg.(*Message))
+				c.saveHistory(message)
+				go c.ackMsg(message)
 				if c.handleMsgFn != nil {
 					for _, fn := range c.handleMsgFn {
-						go fn(c, msg.(*Message))
+						go fn(c, message)
 					}
 				}
 			}
 		}
 	}()
+	if c.myid.Mailid() != "" {
+		go c.bindLoop()
+	}
+	go c.retryLoop()
 	return c.mbox.Start()
 }
 
+// 启动后向自己的 mailbox 注册，mailbox 可能还没连上，失败了就定时重试
+func (c *ChatService) bindLoop() {
+	for {
+		err := c.BindMailbox()
+		if err == nil {
+			return
+		}
+		log.Println("bindMailbox error", "mailbox", c.myid.Mailids(), "err", err)
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-c.stop:
+			return
+		case <-time.After(bindRetry):
+		}
+	}
+}
+
+// 向 myid 中的每一个 mailbox 注册绑定关系
+func (c *ChatService) BindMailbox() error {
+	if c.myid.Mailid() == "" {
+		return errors.New("mailbox not found")
+	}
+	var errs []error
+	for _, mailid := range c.myid.Mailids() {
+		if err := c.mbox.Bind(mailid, c.myid); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// 分页取回 mailid 上的全部离线消息，mailbox 不支持分页时用 PID_MAILBOX_QUERY 一次取回
+func (c *ChatService) queryMailbox(mailid string) (MessageList, error) {
+	var (
+		ml  = make(MessageList, 0)
+		jid = JID(c.myid.Peerid())
+	)
+	if caps := c.capsOf(mailid); caps != nil && !caps.Supports(PID_MAILBOX_PAGE) {
+		bag, err := c.mbox.QueryMsg(mailid, jid)
+		if err != nil {
+			return nil, err
+		}
+		return bag.Messages, nil
+	}
+	for q := (&MailboxQuery{Jid: jid}); ; {
+		page, err := c.mbox.QueryPage(mailid, q)
+		if err != nil && len(ml) == 0 && strings.Contains(err.Error(), "protocol not supported") {
+			page, err = c.mbox.QueryMsg(mailid, jid)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ml = append(ml, page.Messages...)
+		if !page.More {
+			return ml, nil
+		}
+		if len(page.Messages) == 0 {
+			return nil, errors.New("bad mailbox page")
+		}
+		last := page.Messages[len(page.Messages)-1]
+		q = &MailboxQuery{Jid: jid, Ct: last.Envelope.Ct, Id: last.Envelope.Id}
+	}
+}
+
+// 从每一个 mailbox 取回离线消息，按 Envelope.Id 去重，只有全部 mailbox 都失败时才返回错误
 func (c *ChatService) QueryMsg() (*MessageBag, error) {
-	return c.mbox.QueryMsg(c.myid)
+	var (
+		bag  = &MessageBag{Messages: make(MessageList, 0)}
+		seen = make(map[string]struct{})
+		errs []error
+	)
+	for _, mailid := range c.myid.Mailids() {
+		ml, err := c.queryMailbox(mailid)
+		if err != nil {
+			log.Println("queryMsg error", "mailbox", mailid, "err", err)
+			errs = append(errs, err)
+			continue
+		}
+		for _, msg := range ml {
+			if _, ok := seen[msg.Envelope.Id]; !ok {
+				seen[msg.Envelope.Id] = struct{}{}
+				bag.Messages = append(bag.Messages, msg)
+			}
+		}
+	}
+	if len(errs) > 0 && len(errs) == len(c.myid.Mailids()) {
+		return nil, errors.Join(errs...)
+	}
+	sort.Sort(bag.Messages)
+	// 丢弃验签失败的消息，已经收到过的直接从 mailbox 清理
+	var (
+		ml   = make(MessageList, 0, len(bag.Messages))
+		dups = make([]string, 0)
+	)
+	for _, msg := range bag.Messages {
+		if err := msg.Verify(); err != nil {
+			log.Println("queryMsg verify error", "id", msg.Envelope.Id, "from", msg.Envelope.From, "err", err)
+			continue
+		}
+		if c.seen.has(msg.Envelope.Id) {
+			dups = append(dups, msg.Envelope.Id)
+			continue
+		}
+		ml = append(ml, c.openMsg(msg))
+		c.saveHistory(msg)
+		go c.ackMsg(msg)
+	}
+	bag.Messages = ml
+	if len(dups) > 0 {
+		go c.CleanMsg(dups)
+	}
+	return bag, nil
 }
 
+// 在每一个 mailbox 上清理，失败的 mailbox 下次还会返回这些消息
 func (c *ChatService) CleanMsg(ids []string) error {
-	if len(ids) > 0 {
-		return c.mbox.CleanMsg(c.myid, ids)
+	if len(ids) == 0 {
+		return nil
 	}
-	return nil
+	// 清理以后再直连收到同一条消息时丢弃
+	for _, id := range ids {
+		c.seen.add(id)
+	}
+	var errs []error
+	for _, mailid := range c.myid.Mailids() {
+		if err := c.mbox.CleanMsg(mailid, c.myid, ids); err != nil {
+			log.Println("cleanMsg error", "mailbox", mailid, "err", err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// 对方离线时把消息写到对方的每一个 mailbox ，有一个成功就算成功
+func (c *ChatService) putMailbox(msg *Message) error {
+	var (
+		to    = msg.Envelope.To
+		wg    sync.WaitGroup
+		lock  sync.Mutex
+		saved bool
+		errs  []error
+	)
+	if len(to.Mailids()) == 0 {
+		return errors.New("mailbox not found")
+	}
+	for _, mailid := range to.Mailids() {
+		wg.Add(1)
+		go func(mailid string) {
+			defer wg.Done()
+			err := c.putMailboxReplica(mailid, msg)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				log.Println("putMailbox error", "mailbox", mailid, "to", to, "err", err)
+				errs = append(errs, err)
+				return
+			}
+			saved = true
+		}(mailid)
+	}
+	wg.Wait()
+	if saved {
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+func (c *ChatService) putMailboxReplica(mailid string, msg *Message) error {
+	// 先把引用的文件传到 mailbox
+	if b := BlobOf(msg); b != nil {
+		if err := c.pushBlob(mailid, msg.Envelope.To, b.Hash); err != nil {
+			return err
+		}
+	}
+	if err := c.checkSize(mailid, msg.Bytes()); err != nil {
+		return err
+	}
+	rtn, err := c.chunks.request(mailid, PID_MAILBOX, msg.Bytes())
+	if err != nil {
+		return err
+	}
+	// mailbox 拒收时返回 *RspError ，可以用 errors.Is 和 ErrMailboxFull / ErrRateLimited 比较
+	return readRsp(rtn)
 }
 
+// 发送失败的 NormalMsg / SyncMsg / GroupMsg 会进入发送队列重试（对方明确拒收和 mailbox 已满的除外），
+// 发送状态通过 SysMsg 通知 handler ，进入队列时 error 为第一次失败的原因
 func (c *ChatService) SendMsg(msg *Message) error {
 	//log.Println("sendMsg", "msg", string(msg.Json()))
+	smsg, err := c.prepareMsg(msg)
+	if err != nil {
+		return err
+	}
+	status, cause := c.deliverMsg(smsg)
+	if cause != nil {
+		if !queueable(smsg, cause) {
+			return cause
+		}
+		if err = c.enqueue(smsg, cause); err != nil {
+			return err
+		}
+		status = SEND_QUEUED
+	}
+	// 加密前的 msg 保存明文
+	c.saveHistory(msg)
+	c.reportStatus(msg, status, cause)
+	return nil
+}
+
+// 按接收人的 Caps 加密和签名，返回真正发出去的消息
+func (c *ChatService) prepareMsg(msg *Message) (*Message, error) {
 	switch msg.Envelope.Type {
-	case NormalMsg:
-		if _, err := c.p2pservice.RequestWithTimeout(msg.Envelope.To.Peerid(), PID_NORMAL, msg.Bytes(), timeout); err != nil {
-			if _, err := c.p2pservice.RequestWithTimeout(msg.Envelope.To.Mailid(), PID_MAILBOX, msg.Bytes(), timeout); err != nil {
-				log.Println("sendMsg error", "err", err, "msg", string(msg.Json()))
-				return err
+	case NormalMsg, SyncMsg:
+		caps := c.capsOf(msg.Envelope.To.Peerid())
+		if msg.Envelope.Type == NormalMsg && c.isE2E() && !IsE2EMsg(msg) {
+			// 开启 e2e 时不给不支持的节点发明文
+			if caps != nil && !caps.Has(FEATURE_E2E) {
+				log.Println("sendMsg e2e not supported", "to", msg.Envelope.To)
+				return nil, newResponse(RSP_NOT_SUPPORT, errE2ENotSupport).Err()
+			}
+			emsg, err := EncryptMsg(msg)
+			if err != nil {
+				log.Println("sendMsg encrypt error", "err", err, "to", msg.Envelope.To)
+				return nil, err
 			}
+			msg = emsg
 		}
-	case GroupMsg:
-		if _, err := c.p2pservice.RequestWithTimeout(msg.Envelope.Gid.Peerid(), PID_GROUP, msg.Bytes(), timeout); err != nil {
-			if _, err := c.p2pservice.RequestWithTimeout(msg.Envelope.Gid.Mailid(), PID_MAILBOX, msg.Bytes(), timeout); err != nil {
+	case GroupMsg, RtpMsg:
+	default:
+		return nil, errors.New("not support yet")
+	}
+	if err := c.signMsg(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// 投递一次，返回 SEND_DIRECT 或 SEND_MAILBOX
+func (c *ChatService) deliverMsg(msg *Message) (string, error) {
+	switch msg.Envelope.Type {
+	case NormalMsg, SyncMsg:
+		to := msg.Envelope.To.Peerid()
+		if err := c.checkSize(to, msg.Bytes()); err != nil {
+			return "", err
+		}
+		rtn, err := c.chunks.request(to, PID_NORMAL, msg.Bytes())
+		if err == nil {
+			err = readRsp(rtn)
+		}
+		if err != nil {
+			// 对方明确拒收时 mailbox 也不会接收
+			if !IsRetryable(err) {
+				log.Println("sendMsg rejected", "err", err, "id", msg.Envelope.Id, "to", msg.Envelope.To)
+				return "", err
+			}
+			if err := c.putMailbox(msg); err != nil {
 				log.Println("sendMsg error", "err", err, "msg", string(msg.Json()))
-				return err
+				return "", err
 			}
+			return SEND_MAILBOX, nil
+		}
+	case GroupMsg:
+		// 群消息由托管该群的 mailbox 负责分发给群成员
+		rtn, err := c.chunks.request(msg.Envelope.Gid.Mailid(), PID_MAILBOX_GROUP_MSG, msg.Bytes())
+		if err == nil {
+			err = readRsp(rtn)
+		}
+		if err != nil {
+			log.Println("sendMsg error", "err", err, "msg", string(msg.Json()))
+			return "", err
+		}
+		return SEND_MAILBOX, nil
+	case RtpMsg:
+		// 信令是实时的，只走直连
+		rtn, err := c.p2pservice.RequestWithTimeout(msg.Envelope.To.Peerid(), PID_RTP, msg.Bytes(), timeout)
+		if err == nil {
+			err = readRsp(rtn)
+		}
+		if err != nil {
+			log.Println("sendMsg error", "err", err, "msg", string(msg.Json()))
+			return "", err
+		}
+	}
+	return SEND_DIRECT, nil
+}
+
+// 给 msgid 对应消息的发送人 to 回执，event 为 SYNC_DELIVERED 或 SYNC_READ
+func (c *ChatService) SendReceipt(to JID, event string, msgids ...string) error {
+	for _, id := range msgids {
+		if err := c.SendMsg(NewSyncMessage(c.myid, to, event, id)); err != nil {
+			return err
 		}
-	default:
-		return errors.New("not support yet")
+	}
+	return nil
+}
+
+// 要求回执的消息，收到后自动回复已送达
+func (c *ChatService) ackMsg(msg *Message) {
+	if msg.Envelope.Ack != ACK {
+		return
+	}
+	if msg.Envelope.Type != NormalMsg && msg.Envelope.Type != GroupMsg {
+		return
+	}
+	// 离线消息在客户端 ack 之前每次 QueryMsg 都会返回，回执只发一次
+	if !c.acked.add(msg.Envelope.Id) {
+		return
+	}
+	// 对方不认识回执时不发
+	if caps := c.capsOf(msg.Envelope.From.Peerid()); caps != nil && !caps.Has(FEATURE_RECEIPT) {
+		return
+	}
+	if err := c.SendReceipt(msg.Envelope.From, SYNC_DELIVERED, msg.Envelope.Id); err != nil {
+		log.Println("ackMsg error", "id", msg.Envelope.Id, "to", msg.Envelope.From, "err", err)
+	}
+}
+
+// 自己发出的消息用节点私钥签名
+func (c *ChatService) signMsg(msg *Message) error {
+	if msg.Envelope.From.Peerid() != c.myid.Peerid() {
+		return errors.New("from not match myid")
+	}
+	return msg.Sign(c.p2pservice.Nodekey())
+}
+
+// 旧版本节点不签名：没有签名的消息只接受 From 与连接的 pubkey 一致、并且 Caps 为旧版本的节点发来的，有签名的必须验签通过
+func (c *ChatService) verifyNormal(pubkey *ecdsa.PublicKey, msg *Message) error {
+	if len(msg.Sig) > 0 {
+		return msg.Verify()
+	}
+	from, err := alibp2p.ECDSAPubEncode(pubkey)
+	if err != nil {
+		return err
+	}
+	if msg.Envelope.From.Peerid() != from {
+		return errPermissionDenied
+	}
+	if caps := c.capsWait(from); caps == nil || !caps.legacy() {
+		return errNotSigned
 	}
 	return nil
 }
 
 func (c *ChatService) normalService() {
-	c.p2pservice.SetHandler(PID_NORMAL, func(sessionId string, pubkey *ecdsa.PublicKey, rw io.ReadWriter) error {
+	c.chunks.SetHandler(PID_NORMAL, func(sessionId string, pubkey *ecdsa.PublicKey, rw io.ReadWriter) error {
 		msg, err := new(Message).FromReader(rw)
 		if err != nil {
-			rw.Write([]byte(err.Error()))
+			writeRsp(rw, RSP_BAD_REQUEST, err)
 			return err
 		}
-
-		select {
-		case c.recvMsgCh <- msg:
-		case <-c.stop:
-		case <-c.ctx.Done():
+		if err = c.verifyNormal(pubkey, msg.(*Message)); err != nil {
+			log.Println("PID_NORMAL verify error", "session", sessionId, "from", msg.(*Message).Envelope.From, "err", err)
+			code := RSP_UNAUTHORIZED
+			if errors.Is(err, errPermissionDenied) {
+				code = RSP_FORBIDDEN
+			}
+			writeRsp(rw, code, err)
+			return err
 		}
-
-		rw.Write(SUCCESS)
-		return nil
+		c.deliver(msg.(*Message))
+		return writeRsp(rw, RSP_OK, nil)
 	})
 }
 
@@ -167,3 +583,34 @@ func (c *ChatService) normalService() {
 func (c *ChatService) CreateGroup(g *Group) (*GroupRsp, error) {
 	return c.mbox.genGroup(g)
 }
+
+func (c *ChatService) GetGroup(gid GID) (*GroupRsp, error) {
+	return c.mbox.getGroup(gid)
+}
+
+func (c *ChatService) AddMembers(gid GID, members ...*GroupMember) error {
+	return c.mbox.updateMembers(gid, ADD, members)
+}
+
+func (c *ChatService) RemoveMembers(gid GID, ids ...JID) error {
+	members := make([]*GroupMember, 0, len(ids))
+	for _, id := range ids {
+		members = append(members, &GroupMember{Id: id})
+	}
+	return c.mbox.updateMembers(gid, SUB, members)
+}
+
+// action 为 FROM 时从 from 向后列出，为 TO 时向前，from 为空时从链的一端开始
+func (c *ChatService) ListMembers(gid GID, from JID, action MemberAction) ([]*GroupMember, error) {
+	return c.mbox.listMembers(gid, from, action)
+}
+
+// 解散群，只有 owner 可以操作
+func (c *ChatService) DropGroup(gid GID) (*GroupRsp, error) {
+	return c.mbox.dropGroup(gid)
+}
+
+// 从 from 开始向前翻页获取群消息，from 为空时从最新一条开始，返回前会校验 hash 链
+func (c *ChatService) GroupHistory(gid GID, from []byte, limit int) (*GroupHistoryRsp, error) {
+	return c.mbox.groupHistory(gid, from, limit)
+}
@@ -4,7 +4,12 @@
 package chat
 
 import (
+	"crypto/ecdsa"
+	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"github.com/cc14514/go-alibp2p"
 	"github.com/google/uuid"
 	"github.com/tendermint/go-amino"
 	"io"
@@ -40,6 +45,17 @@ const (
 
 const MAX_PKG = 2048
 
+// SyncMsg 的属性：event 为同步的事件，msgid 为对应的消息
+const (
+	SYNC_EVENT_ATTR = "event"
+	SYNC_MSGID_ATTR = "msgid"
+
+	SYNC_DELIVERED = "delivered"
+	SYNC_READ      = "read"
+)
+
+var errBadSignature = errors.New("bad signature")
+
 /*
   {
     "envelope":{
@@ -56,7 +72,8 @@ const MAX_PKG = 2048
     "payload":{
         "attrs":{"k":"v",...},
         "content":"..."
-    }
+    },
+    "sig":"发送人节点私钥对 envelope + payload + vsn 的签名"
   }
 */
 
@@ -96,9 +113,14 @@ type (
 		Envelope Envelope `json:"envelope"`
 		Payload  Payload  `json:"payload,omitempty"`
 		Vsn      string   `json:"vsn,omitempty"`
+		Sig      []byte   `json:"sig,omitempty"` // 发送人对 Envelope + Payload + Vsn 的签名
 	}
 	MessageBag struct {
-		Messages MessageList
+		Messages  MessageList
+		Err       string
+		More      bool // 分页查询时表示后面还有消息
+		Code      int
+		Retryable bool
 	}
 	MessageList []*Message
 
@@ -106,13 +128,62 @@ type (
 		Jid JID
 		Ids []string
 	}
+
+	// 分页查询离线消息，返回 (Ct, Id) 之后的消息，Ct 和 Id 为空时从第一条开始
+	MailboxQuery struct {
+		Jid   JID
+		Ct    int64
+		Id    string
+		Limit int
+	}
 )
 
+func (p *Payload) GetAttr(key string) (string, bool) {
+	for _, a := range p.Attrs {
+		if a.Key == key {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+// 设置 key 对应的值，已存在则覆盖
+func (p *Payload) SetAttr(key, val string) {
+	for i, a := range p.Attrs {
+		if a.Key == key {
+			p.Attrs[i].Val = val
+			return
+		}
+	}
+	p.Attrs = append(p.Attrs, Attr{Key: key, Val: val})
+}
+
+func (p *Payload) DelAttr(keys ...string) {
+	attrs := make([]Attr, 0, len(p.Attrs))
+	for _, a := range p.Attrs {
+		del := false
+		for _, k := range keys {
+			if a.Key == k {
+				del = true
+				break
+			}
+		}
+		if !del {
+			attrs = append(attrs, a)
+		}
+	}
+	p.Attrs = attrs
+}
+
 func (m MessageList) Len() int {
 	return len(m)
 }
 
+// 同一秒内的消息按 id 排序，保证分页的顺序是确定的
 func (m MessageList) Less(i, j int) bool {
+	if m[i].Envelope.Ct == m[j].Envelope.Ct {
+		return m[i].Envelope.Id < m[j].Envelope.Id
+	}
 	return m[i].Envelope.Ct < m[j].Envelope.Ct
 }
 
@@ -143,9 +214,10 @@ func (c *MessageBag) Json() []byte {
 	return d
 }
 
-func NewJID(id, mailbox string) JID {
-	if mailbox != "" {
-		return JID(id + mailbox)
+// 可以有多个 mailbox ，离线消息会写到每一个 mailbox 上
+func NewJID(id string, mailbox ...string) JID {
+	for _, m := range mailbox {
+		id += m
 	}
 	return JID(id)
 }
@@ -154,6 +226,18 @@ func NewNormalMessage(from, to JID, content string, attr ...Attr) *Message {
 	return newMessage(from, to, "", content, NormalMsg, attr...)
 }
 
+func NewGroupMessage(from JID, gid GID, content string, attr ...Attr) *Message {
+	m := newMessage(from, "", "", content, GroupMsg, attr...)
+	m.Envelope.Gid = JID(gid)
+	return m
+}
+
+func NewSyncMessage(from, to JID, event, msgid string) *Message {
+	return newMessage(from, to, "", "", SyncMsg,
+		Attr{Key: SYNC_EVENT_ATTR, Val: event},
+		Attr{Key: SYNC_MSGID_ATTR, Val: msgid})
+}
+
 func NewSysMessage(id string, attr ...Attr) *Message {
 	return newMessage("", "", id, "", SysMsg, attr...)
 }
@@ -180,7 +264,7 @@ func newMessage(from, to JID, id, content string, mt MsgType, attr ...Attr) *Mes
 			Content: content,
 			Attrs:   attr,
 		},
-		Vsn: "0.0.2",
+		Vsn: MSG_VSN,
 	}
 	return m
 }
@@ -192,6 +276,7 @@ func (i JID) Peerid() string {
 	return string(i)[:53]
 }
 
+// 第一个 mailbox
 func (i JID) Mailid() string {
 	if len(i) < 53*2 {
 		return ""
@@ -199,12 +284,30 @@ func (i JID) Mailid() string {
 	return string(i)[53 : 53*2]
 }
 
+// 全部 mailbox
+func (i JID) Mailids() []string {
+	ids := make([]string, 0)
+	for n := 53; n+53 <= len(i); n += 53 {
+		ids = append(ids, string(i)[n:n+53])
+	}
+	return ids
+}
+
+func (i JID) HasMailid(id string) bool {
+	for _, m := range i.Mailids() {
+		if m == id {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Message) FromBytes(data []byte) (Msg, error) {
 	return c, amino.UnmarshalBinaryLengthPrefixed(data, c)
 }
 
 func (c *Message) FromReader(r io.Reader) (Msg, error) {
-	_, err := amino.UnmarshalBinaryLengthPrefixedReader(r, c, MAX_PKG)
+	_, err := amino.UnmarshalBinaryLengthPrefixedReader(r, c, readLimit(r))
 	return c, err
 }
 
@@ -219,6 +322,52 @@ func (c *Message) Hash() []byte {
 	return s1.Sum(nil)
 }
 
+// 签名内容不包含 Sig 本身；群消息由 mailbox 分发时会改写 To ，所以群消息不签 To
+func (c *Message) sigHash() []byte {
+	cpy := Message{Envelope: c.Envelope, Payload: c.Payload, Vsn: c.Vsn}
+	if cpy.Envelope.Type == GroupMsg {
+		cpy.Envelope.To = ""
+	}
+	h := sha256.Sum256(cpy.Bytes())
+	return h[:]
+}
+
+// 用节点私钥签名，签名与传输的 session 无关，从 mailbox 取回的消息同样可以验证
+func (c *Message) Sign(key *ecdsa.PrivateKey) error {
+	sig, err := signHash(key, c.sigHash())
+	if err != nil {
+		return err
+	}
+	c.Sig = sig
+	return nil
+}
+
+// 用 From 中的 peerid 验证签名
+func (c *Message) Verify() error {
+	if len(c.Sig) == 0 {
+		return errNotSigned
+	}
+	return verifyHash(c.Envelope.From.Peerid(), c.sigHash(), c.Sig)
+}
+
+func signHash(key *ecdsa.PrivateKey, h []byte) ([]byte, error) {
+	if key == nil {
+		return nil, errors.New("nodekey not found")
+	}
+	return ecdsa.SignASN1(rand.Reader, key, h)
+}
+
+func verifyHash(peerid string, h, sig []byte) error {
+	pubkey, err := alibp2p.ECDSAPubDecode(peerid)
+	if err != nil {
+		return err
+	}
+	if !ecdsa.VerifyASN1(pubkey, h, sig) {
+		return errBadSignature
+	}
+	return nil
+}
+
 func (c *Message) FromJson(data []byte) (Msg, error) {
 	err := amino.UnmarshalJSON(data, c)
 	return c, err
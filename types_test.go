@@ -67,3 +67,75 @@ func TestMessages(t *testing.T) {
 	t.Log(err, msgs2)
 
 }
+
+func TestMsgSign(t *testing.T) {
+	var (
+		key, id  = newTestKey(t)
+		other, _ = newTestKey(t)
+		_, to    = newTestKey(t)
+		msg      = NewNormalMessage(JID(id), JID(to), "hello")
+		gmsg     = NewGroupMessage(JID(id), testGid, "hello group")
+		forged   = NewNormalMessage(JID(id), JID(to), "forged")
+	)
+	if err := msg.Verify(); err == nil {
+		t.Fatal("unsigned message must not verify")
+	}
+	if err := msg.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	replay, err := new(Message).FromBytes(msg.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replay.(*Message).Verify(); err != nil {
+		t.Fatal(err)
+	}
+	msg.Payload.Content = "changed"
+	if err := msg.Verify(); err == nil {
+		t.Fatal("changed payload must not verify")
+	}
+	if err := forged.Sign(other); err != nil {
+		t.Fatal(err)
+	}
+	if err := forged.Verify(); err == nil {
+		t.Fatal("forged from must not verify")
+	}
+
+	if err := gmsg.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	gmsg.Envelope.To = JID(to)
+	if err := gmsg.Verify(); err != nil {
+		t.Fatal("group message must verify after fan-out", err)
+	}
+}
+
+func TestSyncMessage(t *testing.T) {
+	msg := NewSyncMessage(testOwner, testMember2, SYNC_READ, "mid")
+	event, _ := msg.Payload.GetAttr(SYNC_EVENT_ATTR)
+	msgid, _ := msg.Payload.GetAttr(SYNC_MSGID_ATTR)
+	if msg.Envelope.Type != SyncMsg || event != SYNC_READ || msgid != "mid" || msg.Envelope.To != testMember2 {
+		t.Fatal("bad sync message", string(msg.Json()))
+	}
+}
+
+func TestJIDMailids(t *testing.T) {
+	var (
+		peer = testOwner.Peerid()
+		m1   = testMember1.Mailid()
+		m2   = testMember2.Peerid()
+		jid  = NewJID(peer, m1, m2)
+	)
+	if jid.Peerid() != peer || jid.Mailid() != m1 {
+		t.Fatal("bad jid", jid)
+	}
+	if ids := jid.Mailids(); len(ids) != 2 || ids[0] != m1 || ids[1] != m2 {
+		t.Fatal("bad mailids", ids)
+	}
+	if !jid.HasMailid(m2) || jid.HasMailid(peer) {
+		t.Fatal("bad HasMailid")
+	}
+	if NewJID(peer, "") != JID(peer) || len(JID(peer).Mailids()) != 0 {
+		t.Fatal("jid without mailbox")
+	}
+}